@@ -37,7 +37,7 @@ PCWSTR SUBLAYER_NAME = L"DNS Unleak";
 UINT64 LOWER_FILTER_WEIGHT = 10;
 UINT64 HIGHER_FILTER_WEIGHT = 20;
 
-int main(int argc, char **argv) {
+int wmain(int argc, wchar_t **argv) {
   // Lookup the interface index of NextDNS.
   PIP_ADAPTER_ADDRESSES adaptersAddresses =
       (IP_ADAPTER_ADDRESSES *)malloc(GET_ADAPTERS_ADDRESSES_BUFFER_SIZE);
@@ -103,8 +103,11 @@ int main(int argc, char **argv) {
   // Create our filters:
   //  - The first blocks all UDP traffic bound for port 53.
   //  - The second whitelists all traffic on the TAP device.
+  //  - The third, if an application path is given as argument, whitelists all
+  //    the traffic of this application so the NextDNS service can forward
+  //    queries for local domains to a plain DNS resolver.
   //
-  // Crucially, the second has a higher weight.
+  // Crucially, the second and third have a higher weight.
   //
   // Note:
   //  - Since OutlineService adds a blanket block on all IPv6 traffic, we only need to create IPv4
@@ -166,6 +169,41 @@ int main(int argc, char **argv) {
   }
   wcout << "whitelisted traffic on " << TAP_DEVICE_NAME << " with filter " << filterId << endl;
 
+  // Whitelist all traffic of the given application.
+  if (argc > 1) {
+    FWP_BYTE_BLOB *appId = NULL;
+    result = FwpmGetAppIdFromFileName0(argv[1], &appId);
+    if (result != ERROR_SUCCESS) {
+      wcerr << "could not get the app ID of " << argv[1] << ": " << result << endl;
+      return 1;
+    }
+
+    FWPM_FILTER_CONDITION0 appWhitelistCondition[1];
+    appWhitelistCondition[0].fieldKey = FWPM_CONDITION_ALE_APP_ID;
+    appWhitelistCondition[0].matchType = FWP_MATCH_EQUAL;
+    appWhitelistCondition[0].conditionValue.type = FWP_BYTE_BLOB_TYPE;
+    appWhitelistCondition[0].conditionValue.byteBlob = appId;
+
+    FWPM_FILTER0 appWhitelistFilter;
+    memset(&appWhitelistFilter, 0, sizeof(appWhitelistFilter));
+    appWhitelistFilter.filterCondition = appWhitelistCondition;
+    appWhitelistFilter.numFilterConditions = 1;
+    appWhitelistFilter.displayData.name = (PWSTR)FILTER_PROVIDER_NAME;
+    appWhitelistFilter.subLayerKey = sublayer.subLayerKey;
+    appWhitelistFilter.layerKey = FWPM_LAYER_ALE_AUTH_CONNECT_V4;
+    appWhitelistFilter.action.type = FWP_ACTION_PERMIT;
+    appWhitelistFilter.weight.type = FWP_UINT64;
+    appWhitelistFilter.weight.uint64 = &HIGHER_FILTER_WEIGHT;
+
+    result = FwpmFilterAdd0(engine, &appWhitelistFilter, NULL, &filterId);
+    FwpmFreeMemory0((void **)&appId);
+    if (result != ERROR_SUCCESS) {
+      wcerr << "could not whitelist traffic of " << argv[1] << ": " << result << endl;
+      return 1;
+    }
+    wcout << "whitelisted traffic of " << argv[1] << " with filter " << filterId << endl;
+  }
+
   // Wait forever.
   system("pause");
 }
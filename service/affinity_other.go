@@ -0,0 +1,9 @@
+//+build !windows
+
+package main
+
+import "errors"
+
+func setCPUAffinity(mask uintptr) error {
+	return errors.New("not implemented")
+}
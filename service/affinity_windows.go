@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	k32                        = windows.NewLazySystemDLL("kernel32.dll")
+	procGetProcessAffinityMask = k32.NewProc("GetProcessAffinityMask")
+	procSetProcessAffinityMask = k32.NewProc("SetProcessAffinityMask")
+)
+
+// setCPUAffinity restricts the process to the CPU cores set in mask, after
+// validating them against the cores available on the system.
+func setCPUAffinity(mask uintptr) error {
+	h, err := windows.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	var procMask, sysMask uintptr
+	r, _, err := procGetProcessAffinityMask.Call(uintptr(h),
+		uintptr(unsafe.Pointer(&procMask)),
+		uintptr(unsafe.Pointer(&sysMask)))
+	if r == 0 {
+		return fmt.Errorf("GetProcessAffinityMask: %v", err)
+	}
+	if mask&^sysMask != 0 {
+		return fmt.Errorf("mask %#x includes unavailable cores (available: %#x)", mask, sysMask)
+	}
+	r, _, err = procSetProcessAffinityMask.Call(uintptr(h), mask)
+	if r == 0 {
+		return fmt.Errorf("SetProcessAffinityMask: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nextdns/windows/windoh"
+)
+
+// capabilities describes the features supported by the running system so
+// unsupported ones can be disabled rather than failing at runtime.
+type capabilities struct {
+	OSVersion string
+	OSBuild   uint32
+
+	// NativeDoH is true when Windows can be configured to use DoH natively,
+	// in which case the windoh implementation is used instead of the proxy.
+	NativeDoH bool
+}
+
+func detectCapabilities() capabilities {
+	c := capabilities{NativeDoH: windoh.Available()}
+	c.OSVersion, c.OSBuild = osVersion()
+	return c
+}
+
+// unsupported returns the features not supported by the system with the
+// reason why.
+func (c capabilities) unsupported() map[string]string {
+	u := map[string]string{}
+	if !c.NativeDoH {
+		u["nativeDoH"] = fmt.Sprintf("DNS encryption not configurable on Windows %s, falling back to the proxy", c.OSVersion)
+	}
+	return u
+}
+
+func (c capabilities) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"osVersion": c.OSVersion,
+		"osBuild":   c.OSBuild,
+		"nativeDoH": c.NativeDoH,
+	}
+}
@@ -0,0 +1,9 @@
+//+build !windows
+
+package main
+
+import "runtime"
+
+func osVersion() (string, uint32) {
+	return runtime.GOOS, 0
+}
@@ -16,7 +16,7 @@ type Server struct {
 	Handler EventHandler
 
 	OnStart      func()
-	OnConnect    func(c net.Conn)
+	OnConnect    func(c net.Conn) // called once c receives the broadcasts
 	OnDisconnect func(c net.Conn)
 
 	// ErrorLog specifies an optional log function for errors. If not set,
@@ -25,6 +25,7 @@ type Server struct {
 
 	mu      sync.Mutex
 	clients []net.Conn
+	senders map[net.Conn]bool // clients which sent an event
 	closer  io.Closer
 }
 
@@ -47,11 +48,10 @@ func (h EventHandlerFunc) HandleEvent(e Event) {
 
 // Broadcast broadcasts e to all connected clients.
 func (s *Server) Broadcast(e Event) error {
-	b, err := json.Marshal(e)
+	b, err := encodeEvent(e)
 	if err != nil {
 		return err
 	}
-	b = append(b, '\n')
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -64,11 +64,55 @@ func (s *Server) Broadcast(e Event) error {
 	return nil
 }
 
+// Send sends e to the client c only.
+func (s *Server) Send(c net.Conn, e Event) error {
+	b, err := encodeEvent(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = c.Write(b)
+	return err
+}
+
+func encodeEvent(e Event) ([]byte, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// Clients returns the number of connected clients.
+func (s *Server) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// Listeners returns the number of connected clients which did not send any
+// event. The GUI receives the events on a connection it never writes to and
+// sends each event on a short-lived connection, so this is the number of GUIs
+// listening, excluding the clients connected to send an event.
+func (s *Server) Listeners() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.clients {
+		if !s.senders[c] {
+			n++
+		}
+	}
+	return n
+}
+
 func (s *Server) handleEvents(c net.Conn) {
+	s.addClient(c)
 	if s.OnConnect != nil {
 		s.OnConnect(c)
 	}
-	s.addClient(c)
 	defer func() {
 		s.removeClient(c)
 		c.Close()
@@ -86,6 +130,7 @@ func (s *Server) handleEvents(c net.Conn) {
 			}
 			break
 		}
+		s.markSender(c)
 		if s.Handler != nil {
 			go s.Handler.HandleEvent(e)
 		}
@@ -98,15 +143,25 @@ func (s *Server) addClient(c net.Conn) {
 	s.clients = append(s.clients, c)
 }
 
+func (s *Server) markSender(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.senders == nil {
+		s.senders = map[net.Conn]bool{}
+	}
+	s.senders[c] = true
+}
+
 func (s *Server) removeClient(c net.Conn) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	delete(s.senders, c)
 	clients := make([]net.Conn, 0, len(s.clients))
 	for _, _c := range s.clients {
 		if c == _c {
 			continue
 		}
-		clients = append(s.clients, _c)
+		clients = append(clients, _c)
 	}
 	s.clients = clients
 }
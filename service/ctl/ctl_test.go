@@ -0,0 +1,61 @@
+package ctl
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListeners(t *testing.T) {
+	tests := []struct {
+		name          string
+		listeners     int
+		senders       int
+		wantClients   int
+		wantListeners int
+	}{
+		{"none", 0, 0, 0, 0},
+		{"gui", 1, 0, 1, 1},
+		{"sender only", 0, 1, 1, 0},
+		{"gui and sender", 1, 1, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan Event, tt.senders)
+			s := &Server{Handler: EventHandlerFunc(func(e Event) { received <- e })}
+			var clients []net.Conn
+			defer func() {
+				for _, c := range clients {
+					c.Close()
+				}
+			}()
+			connect := func() net.Conn {
+				client, server := net.Pipe()
+				go s.handleEvents(server)
+				clients = append(clients, client)
+				return client
+			}
+			for i := 0; i < tt.listeners; i++ {
+				connect()
+			}
+			for i := 0; i < tt.senders; i++ {
+				// Senders stay connected after their event is handled.
+				c := connect()
+				if _, err := c.Write([]byte(`{"name":"open"}` + "\n")); err != nil {
+					t.Fatal(err)
+				}
+				<-received
+			}
+			deadline := time.Now().Add(time.Second)
+			for s.Clients() != tt.wantClients && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if n := s.Clients(); n != tt.wantClients {
+				t.Errorf("Clients = %d, want %d", n, tt.wantClients)
+			}
+			if n := s.Listeners(); n != tt.wantListeners {
+				t.Errorf("Listeners = %d, want %d", n, tt.wantListeners)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxDebugDuration bounds the time verbose logging can be enabled for with a
+// single debug-for command.
+const maxDebugDuration = 2 * time.Hour
+
+// debugMode enables verbose logging for a limited duration.
+type debugMode struct {
+	// Always keeps verbose logging enabled, as when running in the
+	// foreground with -debug.
+	Always bool
+
+	// OnChange is called whenever verbose logging is enabled or disabled.
+	OnChange func(enabled bool, until time.Time)
+
+	mu    sync.Mutex
+	timer *time.Timer
+	until time.Time
+}
+
+// EnableFor enables verbose logging for d, then automatically disables it.
+// Calling EnableFor while enabled resets the deadline.
+func (m *debugMode) EnableFor(d time.Duration) {
+	if d > maxDebugDuration {
+		d = maxDebugDuration
+	}
+	m.mu.Lock()
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	m.until = time.Now().Add(d)
+	until := m.until
+	m.timer = time.AfterFunc(d, m.disable)
+	m.mu.Unlock()
+	if m.OnChange != nil {
+		m.OnChange(true, until)
+	}
+}
+
+func (m *debugMode) disable() {
+	m.mu.Lock()
+	m.timer = nil
+	m.until = time.Time{}
+	m.mu.Unlock()
+	if m.OnChange != nil {
+		m.OnChange(false, time.Time{})
+	}
+}
+
+// Enabled returns true if verbose logging is currently enabled.
+func (m *debugMode) Enabled() bool {
+	if m.Always {
+		return true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Now().Before(m.until)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// minGUILaunchInterval is the minimum interval between two launches of the
+// GUI, so repeated open events do not start several instances while the first
+// one starts.
+const minGUILaunchInterval = 10 * time.Second
+
+var errGUILaunchedRecently = errors.New("GUI launched recently")
+
+// guiLauncher opens the GUI window, launching the GUI when none is running.
+type guiLauncher struct {
+	path string
+
+	// launch starts the GUI executable at path, launchGUI if nil.
+	launch func(path string) error
+
+	mu   sync.Mutex
+	last time.Time // last launch attempt
+}
+
+// open asks the listening GUIs to open their window with broadcast or, if none
+// is listening, launches the GUI. Launches are attempted at most once per
+// minGUILaunchInterval, returning errGUILaunchedRecently otherwise. It
+// returns true if the GUI was launched.
+func (l *guiLauncher) open(listeners int, broadcast func()) (launched bool, err error) {
+	if listeners > 0 {
+		broadcast()
+		return false, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() && time.Since(l.last) < minGUILaunchInterval {
+		return false, errGUILaunchedRecently
+	}
+	l.last = time.Now()
+	launch := l.launch
+	if launch == nil {
+		launch = launchGUI
+	}
+	if err := launch(l.path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,9 @@
+//+build !windows
+
+package main
+
+import "errors"
+
+func launchGUI(path string) error {
+	return errors.New("not implemented")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGUILauncherOpen(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name          string
+		listeners     int
+		lastLaunch    time.Duration // ago, 0 for never
+		launchErr     error
+		wantBroadcast bool
+		wantLaunch    bool
+		wantErr       error
+	}{
+		{"gui listening", 1, 0, nil, true, false, nil},
+		{"no gui", 0, 0, nil, false, true, nil},
+		{"launch error", 0, 0, errFailed, false, true, errFailed},
+		{"launched recently", 0, time.Second, nil, false, false, errGUILaunchedRecently},
+		{"launched long ago", 0, 2 * minGUILaunchInterval, nil, false, true, nil},
+		{"listening after a launch", 1, time.Second, nil, true, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var broadcasted, launched bool
+			l := &guiLauncher{
+				path: `C:\Program Files\NextDNS\NextDNS.exe`,
+				launch: func(path string) error {
+					launched = true
+					if path != `C:\Program Files\NextDNS\NextDNS.exe` {
+						t.Errorf("launched %s", path)
+					}
+					return tt.launchErr
+				},
+			}
+			if tt.lastLaunch > 0 {
+				l.last = time.Now().Add(-tt.lastLaunch)
+			}
+			got, err := l.open(tt.listeners, func() { broadcasted = true })
+			if err != tt.wantErr {
+				t.Errorf("open error = %v, want %v", err, tt.wantErr)
+			}
+			if got != (tt.wantLaunch && tt.wantErr == nil) {
+				t.Errorf("open launched = %v", got)
+			}
+			if broadcasted != tt.wantBroadcast || launched != tt.wantLaunch {
+				t.Errorf("broadcasted = %v, launched = %v, want %v, %v", broadcasted, launched, tt.wantBroadcast, tt.wantLaunch)
+			}
+		})
+	}
+}
+
+func TestGUILauncherRateLimit(t *testing.T) {
+	launches := 0
+	l := &guiLauncher{launch: func(string) error {
+		launches++
+		return nil
+	}}
+	for i := 0; i < 3; i++ {
+		_, _ = l.open(0, func() {})
+	}
+	if launches != 1 {
+		t.Errorf("%d launches for repeated open events, want 1", launches)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	procWTSGetActiveConsoleSessionId = k32.NewProc("WTSGetActiveConsoleSessionId")
+	advapi32                         = windows.NewLazySystemDLL("advapi32.dll")
+	procCreateProcessAsUserW         = advapi32.NewProc("CreateProcessAsUserW")
+)
+
+// launchGUI starts the GUI executable at path in the session of the user
+// logged on the console, as the service itself runs in the isolated session 0.
+func launchGUI(path string) error {
+	r, _, _ := procWTSGetActiveConsoleSessionId.Call()
+	session := uint32(r)
+	if session == 0xffffffff {
+		return fmt.Errorf("no user logged on the console")
+	}
+	var token windows.Token
+	if err := windows.WTSQueryUserToken(session, &token); err != nil {
+		return fmt.Errorf("WTSQueryUserToken: %v", err)
+	}
+	defer token.Close()
+	var env *uint16
+	if err := windows.CreateEnvironmentBlock(&env, token, false); err != nil {
+		return fmt.Errorf("CreateEnvironmentBlock: %v", err)
+	}
+	defer func() {
+		_ = windows.DestroyEnvironmentBlock(env)
+	}()
+	cmdLine, err := windows.UTF16PtrFromString(windows.EscapeArg(path))
+	if err != nil {
+		return err
+	}
+	dir, err := windows.UTF16PtrFromString(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	desktop, _ := windows.UTF16PtrFromString(`winsta0\default`)
+	si := windows.StartupInfo{Desktop: desktop}
+	si.Cb = uint32(unsafe.Sizeof(si))
+	var pi windows.ProcessInformation
+	r, _, err = procCreateProcessAsUserW.Call(uintptr(token),
+		0, uintptr(unsafe.Pointer(cmdLine)),
+		0, 0, 0, // process and thread attributes, inherit handles
+		windows.CREATE_UNICODE_ENVIRONMENT, uintptr(unsafe.Pointer(env)),
+		uintptr(unsafe.Pointer(dir)),
+		uintptr(unsafe.Pointer(&si)), uintptr(unsafe.Pointer(&pi)))
+	if r == 0 {
+		return fmt.Errorf("CreateProcessAsUser: %v", err)
+	}
+	_ = windows.CloseHandle(pi.Thread)
+	_ = windows.CloseHandle(pi.Process)
+	return nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"hash/crc64"
@@ -8,13 +10,18 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/denisbrodbeck/machineid"
 
 	"github.com/nextdns/windows/ctl"
 	"github.com/nextdns/windows/proxy"
 	"github.com/nextdns/windows/settings"
+	"github.com/nextdns/windows/statsd"
 	"github.com/nextdns/windows/svc"
 	"github.com/nextdns/windows/updater"
 	"github.com/nextdns/windows/windoh"
@@ -32,38 +39,215 @@ type nextdnsSvc struct {
 	impl impl
 	ctl  ctl.Server
 	log  svc.Logger
+
+	stopTimeout time.Duration
+	cpuAffinity uintptr // no affinity change if 0
+
+	// OnLifecycle is called with the service-starting, service-ready,
+	// service-stopping and service-stopped events as the service goes through
+	// them.
+	OnLifecycle func(e ctl.Event)
+
+	lifecycleMu   sync.Mutex
+	lastLifecycle ctl.Event // last lifecycle event, replayed to new clients
+
+	// featuresFile is where the feature toggles are persisted, if not empty.
+	featuresFile string
+
+	mu             sync.Mutex
+	settings       map[string]interface{} // last settings applied, without the feature toggles
+	settingsSource string                 // settings.Source* the settings come from
+	features       map[string]interface{} // feature toggles, see settings.WithFeatures
+}
+
+// StopTimeout implements the svc.StopTimeouter interface.
+func (s *nextdnsSvc) StopTimeout() time.Duration {
+	return s.stopTimeout
+}
+
+func (s *nextdnsSvc) setSettings(m map[string]interface{}, source string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings = m
+	s.settingsSource = source
+}
+
+// lastSettings returns the last settings applied with the feature toggles.
+func (s *nextdnsSvc) lastSettings() (map[string]interface{}, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.withFeaturesLocked(s.settings), s.settingsSource
+}
+
+// withFeaturesLocked returns m with the feature toggles applied.
+func (s *nextdnsSvc) withFeaturesLocked(m map[string]interface{}) map[string]interface{} {
+	if len(s.features) == 0 {
+		return m
+	}
+	m, _ = settings.WithFeatures(m, s.features) // checked by toggleFeatures
+	return m
+}
+
+func (s *nextdnsSvc) effectiveConfig() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	eff := settings.Effective(s.withFeaturesLocked(s.settings), s.settingsSource)
+	for name := range s.features {
+		if _, set := s.settings[name]; !set {
+			eff[name].(map[string]interface{})["source"] = settings.SourceFeatures
+		}
+	}
+	return map[string]interface{}{
+		"settings": eff,
+		"state":    s.impl.State(),
+	}
+}
+
+// toggleFeatures toggles the features f on top of the last settings, applying
+// the result with apply, and persists the toggles to featuresFile. Features
+// set by the settings cannot be toggled so they keep a single source.
+func (s *nextdnsSvc) toggleFeatures(f map[string]interface{}, apply func(m map[string]interface{}, source string) error) error {
+	if err := settings.CheckFeatures(f); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	m, source, prev := s.settings, s.settingsSource, s.features
+	s.mu.Unlock()
+	if m == nil {
+		return errors.New("no settings received yet")
+	}
+	toggles := make(map[string]interface{}, len(prev)+len(f))
+	for name, on := range prev {
+		toggles[name] = on
+	}
+	for name, on := range f {
+		if _, set := m[name]; set {
+			return fmt.Errorf("feature %s is set by the %s settings", name, source)
+		}
+		toggles[name] = on
+	}
+	s.setFeatures(toggles)
+	if err := apply(m, source); err != nil {
+		s.setFeatures(prev)
+		return err
+	}
+	if s.featuresFile == "" {
+		return nil
+	}
+	return settings.WriteFeatures(s.featuresFile, toggles)
+}
+
+func (s *nextdnsSvc) setFeatures(f map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.features = f
+}
+
+func (s *nextdnsSvc) lifecycle(event string) {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	e := ctl.Event{Name: event, Data: map[string]interface{}{
+		"time": time.Now().Format(time.RFC3339Nano),
+	}}
+	s.lastLifecycle = e
+	if s.OnLifecycle != nil {
+		s.OnLifecycle(e)
+	}
+}
+
+// replayLifecycle sends the last lifecycle event to the client c, which may
+// have connected after it was broadcasted. The lock orders it with the
+// broadcast of the next events.
+func (s *nextdnsSvc) replayLifecycle(c net.Conn) error {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	if s.lastLifecycle.Name == "" {
+		return nil
+	}
+	return s.ctl.Send(c, s.lastLifecycle)
 }
 
 func (s *nextdnsSvc) Start(log svc.Logger) error {
 	s.log = log
 	log.Info("Service starting")
 	defer log.Info("Service started")
-	return s.ctl.Start()
+	s.lifecycle("service-starting")
+	if s.cpuAffinity != 0 {
+		if err := setCPUAffinity(s.cpuAffinity); err != nil {
+			log.Error(fmt.Sprintf("cannot set CPU affinity: %v", err))
+		} else {
+			log.Info(fmt.Sprintf("CPU affinity set to %#x", s.cpuAffinity))
+		}
+	}
+	if s.featuresFile != "" {
+		// Before the GUI connects and sends the settings.
+		if f, err := settings.ReadFeatures(s.featuresFile); err != nil {
+			log.Error(fmt.Sprintf("cannot read feature toggles: %v", err))
+		} else {
+			s.setFeatures(f)
+		}
+	}
+	if err := s.ctl.Start(); err != nil {
+		return err
+	}
+	s.lifecycle("service-ready")
+	return nil
 }
 
 func (s *nextdnsSvc) Stop(log svc.Logger) error {
 	s.log = log
 	log.Info("Service stopping")
 	defer log.Info("Service stopped")
+	s.lifecycle("service-stopping")
 	if err := s.impl.Stop(); err != nil {
 		return err
 	}
+	// Sent before closing the ctl server so connected clients receive it.
+	s.lifecycle("service-stopped")
 	return s.ctl.Stop()
 }
 
+// serviceArgs returns the flags set in fs, except the ones selecting what
+// to run, so -service install has the service started with them.
+func serviceArgs(fs *flag.FlagSet) []string {
+	var args []string
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "service", "debug":
+			return
+		}
+		args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+	})
+	return args
+}
+
 func main() {
-	debug := flag.Bool("debug", false, "Enable debug mode")
-	svcFlag := flag.String("service", "", "Control the system service (actions: install, uninstall, start, stop)")
+	debug := flag.Bool("debug", false, "Run in the foreground instead of under the SCM, logging each query to the console (stop with Ctrl+C)")
+	svcFlag := flag.String("service", "", "Control the system service (actions: install, uninstall, start, stop). The other flags given to install are passed to the service on each start")
+	stopTimeout := flag.Duration("stop-timeout", svc.DefaultStopTimeout, fmt.Sprintf("Time given to the service to stop (max %v)", svc.MaxStopTimeout))
+	cpuAffinity := flag.String("cpu-affinity", "", "Bitmask of the CPU cores the service is allowed to run on (e.g. 0x3)")
+	upstreamAllowlist := flag.String("upstream-allowlist", "", "Comma separated list of hostnames or domains upstreams and forwarders set from the GUI must match (default no restriction)")
+	guiPath := flag.String("gui-path", "", "Path of the GUI executable launched when asked to open it while it is not running (default NextDNS.exe next to the service)")
+	summaryInterval := flag.Duration("summary-interval", 0, "Interval at which a summary of the activity is logged (e.g. 1h, default disabled)")
 	flag.Parse()
 
 	name := "NextDNSService"
 	displayName := "NextDNS Service"
 	desc := "NextDNS DNS53 to DoH proxy."
 
+	var mask uint64
+	if *cpuAffinity != "" {
+		var err error
+		if mask, err = strconv.ParseUint(*cpuAffinity, 0, strconv.IntSize); err != nil || mask == 0 {
+			fmt.Println("invalid CPU affinity mask")
+			return
+		}
+	}
+
 	var err error
 	switch *svcFlag {
 	case "install":
-		err = svc.Install(name, displayName, desc)
+		err = svc.Install(name, displayName, desc, serviceArgs(flag.CommandLine)...)
 	case "uninstall", "remove":
 		err = svc.Remove(name)
 	case "start":
@@ -71,7 +255,21 @@ func main() {
 	case "stop":
 		err = svc.Stop(name)
 	case "":
-		err = run(*debug)
+		if launchedByHand(*debug, svc.IsInteractive) {
+			fmt.Printf("%s is meant to run as a Windows service, which the NextDNS installer sets up.\n", displayName)
+			fmt.Println("To set it up manually, run with -service install then -service start.")
+			fmt.Println("To run it in the foreground for troubleshooting, run with -debug.")
+			return
+		}
+		var allowedUpstreams []string
+		if *upstreamAllowlist != "" {
+			allowedUpstreams = strings.Split(*upstreamAllowlist, ",")
+		}
+		if *guiPath == "" {
+			ex, _ := os.Executable()
+			*guiPath = filepath.Join(filepath.Dir(ex), "NextDNS.exe")
+		}
+		err = run(*debug, *stopTimeout, uintptr(mask), allowedUpstreams, *summaryInterval, *guiPath)
 	default:
 		fmt.Println("invalid service action")
 	}
@@ -80,7 +278,43 @@ func main() {
 	}
 }
 
-func run(debug bool) error {
+// proxyOptions returns the proxy options set by stg.
+func proxyOptions(stg settings.Settings) proxy.Options {
+	return proxy.Options{
+		StripHTTPSRecords:   stg.StripHTTPSRecords,
+		RotateAnswers:       stg.RotateAnswers,
+		MirrorUpstream:      stg.MirrorUpstream,
+		LocalDomains:        stg.LocalDomains,
+		LocalResolver:       stg.LocalResolver,
+		StaticHosts:         stg.StaticHosts,
+		RebindingProtection: stg.RebindingProtection,
+		RebindingAllowlist:  stg.RebindingAllowlist,
+		AuthoritativeLocal:  stg.AuthoritativeLocal,
+		TrackHotNames:       stg.TrackHotNames,
+
+		RouterRefreshInterval: stg.RouterRefreshInterval,
+		RaceBootstrap:         stg.RaceBootstrap,
+		StartupBehavior:       stg.StartupBehavior,
+		StartupTimeout:        stg.StartupTimeout,
+		NetworkRecovery:       stg.NetworkRecovery,
+		SOA: proxy.SOA{
+			MName:  stg.SOAMName,
+			RName:  stg.SOARName,
+			MinTTL: stg.SOAMinTTL,
+		},
+		MaxNegativeTTL:            stg.MaxNegativeTTL,
+		PreferredRetryInterval:    stg.PreferredRetryInterval,
+		PreferredRetryMaxInterval: stg.PreferredRetryMaxInterval,
+		IdleTimeout:               stg.IdleTimeout,
+		ForwardUnsupportedEDNS:    stg.ForwardUnsupportedEDNS,
+		MaxInflight:               stg.MaxInflight,
+		StartBackoffThreshold:     stg.StartBackoffThreshold,
+		StartBackoffMax:           stg.StartBackoffMax,
+		DSCP:                      stg.DSCP,
+	}
+}
+
+func run(debug bool, stopTimeout time.Duration, cpuAffinity uintptr, allowedUpstreams []string, summaryInterval time.Duration, guiPath string) error {
 	vers := updater.CurrentVersion()
 	if vers == "" {
 		vers = "dev"
@@ -90,6 +324,10 @@ func run(debug bool) error {
 		URL: "https://storage.googleapis.com/nextdns_windows/info.json",
 	}
 
+	caps := detectCapabilities()
+	sd := &statsd.Client{}
+	dbg := &debugMode{Always: debug}
+
 	var s *nextdnsSvc
 	broadcast := func(name string, data map[string]interface{}) {
 		s.log.Info(fmt.Sprintf("send event: %v %v", name, data))
@@ -97,11 +335,74 @@ func run(debug bool) error {
 			s.log.Error(fmt.Sprintf("send event error: %v", err))
 		}
 	}
+	// applySettings applies the settings m received from the GUI or read from
+	// a file, source being one of the settings.Source* values. They are
+	// checked first so invalid settings are rejected without changing
+	// anything.
+	applySettings := func(m map[string]interface{}, source string) error {
+		s.mu.Lock()
+		stg := settings.FromMap(s.withFeaturesLocked(m))
+		s.mu.Unlock()
+		p, isProxy := s.impl.(*proxy.Proxy)
+		var opts proxy.Options
+		if isProxy {
+			opts = proxyOptions(stg)
+			if err := p.CheckOptions(opts); err != nil {
+				return err
+			}
+		}
+		s.setSettings(m, source)
+		s.impl.SetConfigID(stg.Configuration)
+		if stg.ReportDeviceName {
+			name := stg.DeviceName
+			if name == "" {
+				name = getHostname()
+			}
+			s.impl.SetDeviceInfo(name, getModel(), getShortMachineID(), vers)
+		} else {
+			s.impl.SetDeviceInfo("", "", "", vers)
+		}
+		up.SetAutoRun(stg.CheckUpdates)
+		if isProxy {
+			_ = p.SetOptions(opts) // checked above
+		}
+		statsdPrefix := stg.StatsDPrefix
+		if statsdPrefix == "" {
+			statsdPrefix = "nextdns."
+		}
+		sd.SetConfig(stg.StatsDAddr, statsdPrefix, stg.StatsDTags, stg.StatsDFlushInterval)
+
+		// Switch connection status
+		var err error
+		if stg.Enabled {
+			s.log.Info("Starting service")
+			err = s.impl.Start()
+		} else {
+			s.log.Info("Stopping service")
+			err = s.impl.Stop()
+		}
+		if err != nil {
+			broadcast("status", map[string]interface{}{
+				"state": s.impl.State(),
+				"error": err.Error(),
+			})
+		}
+		return nil
+	}
+
+	ex, _ := os.Executable()
+	gui := &guiLauncher{path: guiPath}
 	s = &nextdnsSvc{
+		stopTimeout:  stopTimeout,
+		cpuAffinity:  cpuAffinity,
+		featuresFile: filepath.Join(filepath.Dir(ex), "features.json"),
 		ctl: ctl.Server{
 			Namespace: "NextDNS",
 			OnConnect: func(c net.Conn) {
 				s.log.Info(fmt.Sprintf("UI Connect: %v", c))
+				if err := s.replayLifecycle(c); err != nil {
+					s.log.Error(fmt.Sprintf("send lifecycle event error: %v", err))
+				}
 			},
 			OnDisconnect: func(c net.Conn) {
 				s.log.Info(fmt.Sprintf("UI Disconnect: %v", c))
@@ -111,37 +412,172 @@ func run(debug bool) error {
 				switch e.Name {
 				case "open":
 					// Use to open the GUI window in the existing instance of
-					// the app when a duplicate instance is open.
-					broadcast("open", nil)
+					// the app when a duplicate instance is open. If no GUI
+					// listens, the event would be lost: start the GUI
+					// instead.
+					launched, err := gui.open(s.ctl.Listeners(), func() {
+						broadcast("open", nil)
+					})
+					if err != nil {
+						s.log.Error(fmt.Sprintf("cannot launch GUI: %v", err))
+					} else if launched {
+						s.log.Info(fmt.Sprintf("No GUI connected, launched %s", guiPath))
+					}
 				case "settings":
 					if e.Data == nil {
 						return
 					}
-					// Apply settings
-					stg := settings.FromMap(e.Data)
-					s.impl.SetConfigID(stg.Configuration)
-					if stg.ReportDeviceName {
-						s.impl.SetDeviceInfo(getHostname(), getModel(), getShortMachineID(), vers)
-					} else {
-						s.impl.SetDeviceInfo("", "", "", vers)
+					if err := applySettings(e.Data, settings.SourceGUI); err != nil {
+						s.log.Error(fmt.Sprintf("settings rejected: %v", err))
 					}
-					up.SetAutoRun(stg.CheckUpdates)
-
-					// Switch connection status
+				case "apply-config-file":
+					// Apply all the settings from a file of the config
+					// directory, which name is given in e.Data, as a whole
+					// or not at all, for deployments managed as code.
+					name, _ := e.Data["name"].(string)
+					data := map[string]interface{}{"name": name}
+					path, err := fileInDir(serviceDir("config"), name)
+					var m map[string]interface{}
+					if err == nil {
+						m, err = settings.ReadFile(path)
+					}
+					if err == nil {
+						err = applySettings(m, settings.SourceFile)
+					}
+					if err != nil {
+						data["error"] = err.Error()
+					}
+					broadcast("apply-config-file", data)
+				case "debug-for":
+					// Temporarily log each query to capture a transient
+					// issue without leaving verbose logging on.
+					minutes, _ := e.Data["minutes"].(float64)
+					if minutes <= 0 {
+						s.log.Error(fmt.Sprintf("invalid debug-for duration: %v", e.Data["minutes"]))
+						return
+					}
+					dbg.EnableFor(time.Duration(minutes * float64(time.Minute)))
+				case "capabilities":
+					// Let the GUI hide options not supported by the system.
+					broadcast("capabilities", caps.toMap())
+				case "export-hotnames":
+					// Export the most queried names to seed the warmup list
+					// of other machines.
+					p, ok := s.impl.(*proxy.Proxy)
+					if !ok {
+						s.log.Error("export-hotnames: not supported with native DoH")
+						return
+					}
+					limit, _ := e.Data["limit"].(float64)
+					private, _ := e.Data["excludePrivate"].(bool)
+					broadcast("hotnames", map[string]interface{}{
+						"names": p.HotNames(int(limit), private),
+					})
+				case "validate-config":
+					// Check a configuration ID entered in the GUI without
+					// changing the active configuration.
+					id, _ := e.Data["configuration"].(string)
+					var result string
 					var err error
-					if stg.Enabled {
-						s.log.Info("Starting service")
-						err = s.impl.Start()
+					if p, ok := s.impl.(*proxy.Proxy); ok {
+						result, err = p.ValidateConfigID(context.Background(), id)
 					} else {
-						s.log.Info("Stopping service")
-						err = s.impl.Stop()
+						result, err = proxy.ValidateConfigID(context.Background(), nil, id)
+					}
+					data := map[string]interface{}{
+						"configuration": id,
+						"result":        result,
 					}
 					if err != nil {
-						broadcast("status", map[string]interface{}{
-							"state": s.impl.State(),
-							"error": err.Error(),
-						})
+						data["error"] = err.Error()
+					}
+					broadcast("validate-config", data)
+				case "reset-connections":
+					p, ok := s.impl.(*proxy.Proxy)
+					if !ok {
+						s.log.Error("reset-connections: not supported with native DoH")
+						return
 					}
+					n, err := p.ResetConnections()
+					data := map[string]interface{}{"reset": n}
+					if err != nil {
+						data["error"] = err.Error()
+					}
+					broadcast("reset-connections", data)
+				case "benchmark":
+					p, ok := s.impl.(*proxy.Proxy)
+					if !ok {
+						s.log.Error("benchmark: not supported with native DoH")
+						return
+					}
+					count, _ := e.Data["count"].(float64)
+					var names []string
+					if v, ok := e.Data["names"].([]interface{}); ok {
+						for _, name := range v {
+							if name, ok := name.(string); ok {
+								names = append(names, name)
+							}
+						}
+					}
+					// Run in the background as it may take up to 30s. A
+					// benchmark requested while one runs gets an error. The
+					// proxy has no cache, so no hit rate is reported.
+					go func() {
+						r, err := p.Benchmark(context.Background(), names, int(count))
+						ms := func(d time.Duration) float64 {
+							return float64(d) / float64(time.Millisecond)
+						}
+						data := map[string]interface{}{
+							"queries":   r.Queries,
+							"errors":    r.Errors,
+							"minMs":     ms(r.Min),
+							"avgMs":     ms(r.Avg),
+							"p95Ms":     ms(r.P95),
+							"maxMs":     ms(r.Max),
+							"timedOut":  r.TimedOut,
+							"truncated": r.Truncated,
+						}
+						if err != nil {
+							data["error"] = err.Error()
+						}
+						broadcast("benchmark", data)
+					}()
+				case "snapshot", "restore-snapshot":
+					// Snapshots are files of the snapshots directory, which
+					// name is given in e.Data.
+					name, _ := e.Data["name"].(string)
+					data := map[string]interface{}{"name": name}
+					path, err := fileInDir(serviceDir("snapshots"), name)
+					if !dbg.Always {
+						// Not with debug-for, which any client can send.
+						err = errors.New("only available when running with -debug")
+					}
+					if err == nil && e.Name == "snapshot" {
+						err = s.writeSnapshot(path)
+					} else if err == nil {
+						err = s.restoreSnapshot(path, applySettings)
+					}
+					if err != nil {
+						data["error"] = err.Error()
+					}
+					broadcast(e.Name, data)
+				case "effective-config":
+					// Report the settings currently applied in memory with
+					// the source of each value.
+					broadcast("effective-config", s.effectiveConfig())
+				case "features":
+					// Report the feature flags, toggling those in e.Data
+					// first. The change is applied live like new settings
+					// and persisted.
+					data := map[string]interface{}{}
+					if len(e.Data) > 0 {
+						if err := s.toggleFeatures(e.Data, applySettings); err != nil {
+							data["error"] = err.Error()
+						}
+					}
+					m, _ := s.lastSettings()
+					data["features"] = settings.FromMap(m).Features()
+					broadcast("features", data)
 				default:
 					s.log.Error(fmt.Sprintf("invalid event: %v", e))
 				}
@@ -149,7 +585,7 @@ func run(debug bool) error {
 		},
 	}
 
-	if windoh.Available() {
+	if caps.NativeDoH {
 		s.impl = &windoh.Config{
 			OnStateChange: func(state string) {
 				broadcast("status", map[string]interface{}{"state": state})
@@ -157,14 +593,45 @@ func run(debug bool) error {
 		}
 	} else {
 		s.impl = &proxy.Proxy{
-			Upstream: "https://dns.nextdns.io/",
+			Upstream:         "https://dns.nextdns.io/",
+			StatsD:           sd,
+			AllowedUpstreams: allowedUpstreams,
+			SummaryInterval:  summaryInterval,
+			EndpointFile:     filepath.Join(filepath.Dir(ex), "endpoint.txt"),
 			// Bootstrap with a fake transport that avoid DNS lookup
 			OnStateChange: func(state string) {
 				broadcast("status", map[string]interface{}{"state": state})
 			},
-			// QueryLog: func(msgID uint16, qname string) {
-			// 	s.log.Info(fmt.Sprintf("resolve %x %s", msgID, qname))
-			// },
+			OnEndpointsChange: func(endpoints []string) {
+				broadcast("endpoints", map[string]interface{}{"endpoints": endpoints})
+			},
+			OnRecover: func(endpoint string) {
+				broadcast("recovery", map[string]interface{}{"endpoint": endpoint})
+			},
+			OnPreferredEndpoint: func(endpoint string) {
+				broadcast("preferred-endpoint", map[string]interface{}{"endpoint": endpoint})
+			},
+			OnStartBackoff: func(failures int, delay time.Duration) {
+				broadcast("start-backoff", map[string]interface{}{
+					"failures": failures,
+					"delay":    delay.Seconds(),
+					"until":    time.Now().Add(delay).Format(time.RFC3339),
+				})
+			},
+			OnClockSkew: func(err error) {
+				broadcast("clock-skew", map[string]interface{}{
+					"time":     time.Now().Format(time.RFC3339),
+					"error":    err.Error(),
+					"guidance": "NextDNS certificates are seen as not valid, check the date and time of the system are correct",
+				})
+			},
+			// Each line of a query starts with the same query ID so the
+			// logs can be filtered for it (e.g. findstr "query 0000002a").
+			TraceLog: func(traceID uint32, msgID uint16, event, detail string) {
+				if dbg.Enabled() {
+					s.log.Info(fmt.Sprintf("query %08x: %s %x %s", traceID, event, msgID, detail))
+				}
+			},
 			InfoLog: func(msg string) {
 				s.log.Info(msg)
 			},
@@ -183,6 +650,25 @@ func run(debug bool) error {
 	up.ErrorLog = func(err error) {
 		s.log.Error(fmt.Sprint(err))
 	}
+	dbg.OnChange = func(enabled bool, until time.Time) {
+		data := map[string]interface{}{"enabled": enabled}
+		if enabled {
+			data["until"] = until.Format(time.RFC3339)
+		}
+		broadcast("debug", data)
+	}
+	s.OnLifecycle = func(e ctl.Event) {
+		broadcast(e.Name, e.Data)
+	}
+	sd.ErrorLog = func(err error) {
+		s.log.Error(fmt.Sprint(err))
+	}
+	s.ctl.OnStart = func() {
+		s.log.Info(fmt.Sprintf("Detected OS version %s", caps.OSVersion))
+		for feature, reason := range caps.unsupported() {
+			s.log.Info(fmt.Sprintf("Disabling %s: %s", feature, reason))
+		}
+	}
 	log.SetOutput(writerFunc(func(b []byte) (n int, err error) {
 		s.log.Info(string(b))
 		return len(b), nil
@@ -191,6 +677,18 @@ func run(debug bool) error {
 	return svc.Run(s, "NextDNSService", debug)
 }
 
+// launchedByHand returns true if the process was launched by a user (e.g.
+// double-clicked) instead of by the SCM, without asking to run in the
+// foreground with debug. If the detection fails, the process is assumed to run
+// as a service.
+func launchedByHand(debug bool, isInteractive func() (bool, error)) bool {
+	if debug {
+		return false
+	}
+	interactive, err := isInteractive()
+	return err == nil && interactive
+}
+
 type writerFunc func(p []byte) (n int, err error)
 
 func (w writerFunc) Write(p []byte) (n int, err error) {
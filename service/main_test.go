@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nextdns/windows/ctl"
+	"github.com/nextdns/windows/proxy"
+	"github.com/nextdns/windows/settings"
+)
+
+// testImpl is an impl whose Stop returns err.
+type testImpl struct {
+	err error
+}
+
+func (testImpl) SetConfigID(id string)                         {}
+func (testImpl) SetDeviceInfo(name, model, id, version string) {}
+func (testImpl) State() string                                 { return "stopped" }
+func (testImpl) Start() error                                  { return nil }
+func (i testImpl) Stop() error                                 { return i.err }
+
+type nopLogger struct{}
+
+func (nopLogger) Info(string)  {}
+func (nopLogger) Warn(string)  {}
+func (nopLogger) Error(string) {}
+
+func TestStopLifecycle(t *testing.T) {
+	tests := []struct {
+		name    string
+		stopErr error
+		want    []string
+	}{
+		{"stopped", nil, []string{"service-stopping", "service-stopped"}},
+		{"stop error", errors.New("failed"), []string{"service-stopping"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []string
+			s := &nextdnsSvc{impl: testImpl{err: tt.stopErr}}
+			s.OnLifecycle = func(e ctl.Event) {
+				if _, ok := e.Data["time"].(string); !ok {
+					t.Errorf("event %s has no time", e.Name)
+				}
+				events = append(events, e.Name)
+			}
+			if err := s.Stop(nopLogger{}); err != tt.stopErr {
+				t.Errorf("Stop = %v, want %v", err, tt.stopErr)
+			}
+			if !reflect.DeepEqual(events, tt.want) {
+				t.Errorf("events = %v, want %v", events, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayLifecycle(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []string
+		want   string // "" if nothing is replayed
+	}{
+		{"none", nil, ""},
+		{"starting", []string{"service-starting"}, "service-starting"},
+		{"ready", []string{"service-starting", "service-ready"}, "service-ready"},
+		{"stopped", []string{"service-starting", "service-ready", "service-stopping", "service-stopped"}, "service-stopped"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &nextdnsSvc{}
+			for _, e := range tt.events {
+				s.lifecycle(e)
+			}
+			client, server := net.Pipe()
+			defer client.Close()
+			errc := make(chan error, 1)
+			go func() {
+				errc <- s.replayLifecycle(server)
+				server.Close()
+			}()
+			var got ctl.Event
+			err := json.NewDecoder(client).Decode(&got)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatalf("replayLifecycle = %v", err)
+			}
+			if got.Name != tt.want {
+				t.Errorf("replayed %q, want %q", got.Name, tt.want)
+			}
+			if tt.want != "" && got.Data["time"] != s.lastLifecycle.Data["time"] {
+				t.Errorf("replayed time %v, want %v", got.Data["time"], s.lastLifecycle.Data["time"])
+			}
+		})
+	}
+}
+
+func TestLaunchedByHand(t *testing.T) {
+	tests := []struct {
+		name        string
+		debug       bool
+		interactive bool
+		err         error
+		want        bool
+	}{
+		{"service", false, false, nil, false},
+		{"interactive", false, true, nil, true},
+		{"debug", true, true, nil, false},
+		{"detection error", false, true, errors.New("failed"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := launchedByHand(tt.debug, func() (bool, error) {
+				return tt.interactive, tt.err
+			})
+			if got != tt.want {
+				t.Errorf("launchedByHand = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToggleFeatures(t *testing.T) {
+	errRejected := errors.New("rejected")
+	gui := map[string]interface{}{"configuration": "abcdef", "stripHTTPSRecords": true}
+	tests := []struct {
+		name     string
+		f        map[string]interface{}
+		applyErr error
+		wantErr  bool
+		want     map[string]bool
+	}{
+		{"enable", map[string]interface{}{"rotateAnswers": true}, nil, false,
+			map[string]bool{"rotateAnswers": true, "stripHTTPSRecords": true}},
+		{"set by the settings", map[string]interface{}{"stripHTTPSRecords": false}, nil, true,
+			map[string]bool{"stripHTTPSRecords": true}},
+		{"unknown", map[string]interface{}{"dnssec": true}, nil, true, nil},
+		{"apply error", map[string]interface{}{"rotateAnswers": true}, errRejected, true,
+			map[string]bool{"rotateAnswers": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "features")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			s := &nextdnsSvc{impl: testImpl{}, featuresFile: filepath.Join(dir, "features.json")}
+			var applied settings.Settings
+			var applyErr error
+			apply := func(m map[string]interface{}, source string) error {
+				if applyErr != nil {
+					return applyErr
+				}
+				s.mu.Lock()
+				applied = settings.FromMap(s.withFeaturesLocked(m))
+				s.mu.Unlock()
+				s.setSettings(m, source)
+				return nil
+			}
+			if err := apply(gui, settings.SourceGUI); err != nil {
+				t.Fatal(err)
+			}
+			applyErr = tt.applyErr
+			if err := s.toggleFeatures(tt.f, apply); (err != nil) != tt.wantErr {
+				t.Fatalf("toggleFeatures = %v, want error %v", err, tt.wantErr)
+			}
+			applyErr = nil
+			// The toggles survive the next settings sent by the GUI.
+			if err := apply(gui, settings.SourceGUI); err != nil {
+				t.Fatal(err)
+			}
+			features := applied.Features()
+			for name, want := range tt.want {
+				if features[name] != want {
+					t.Errorf("feature %s = %v, want %v", name, features[name], want)
+				}
+			}
+			persisted, err := settings.ReadFeatures(s.featuresFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr && persisted != nil {
+				t.Errorf("toggles %v persisted after an error", persisted)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(persisted, tt.f) {
+				t.Errorf("persisted toggles = %v, want %v", persisted, tt.f)
+			}
+			if !tt.wantErr {
+				eff := s.effectiveConfig()["settings"].(map[string]interface{})
+				for name := range tt.f {
+					if src := eff[name].(map[string]interface{})["source"]; src != settings.SourceFeatures {
+						t.Errorf("source of %s = %v, want %s", name, src, settings.SourceFeatures)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	full := `{
+		"enabled": true,
+		"configuration": "abcdef",
+		"reportDeviceName": true,
+		"deviceName": "office",
+		"checkUpdates": false,
+		"updateChannel": "beta",
+		"stripHTTPSRecords": true,
+		"rotateAnswers": true,
+		"mirrorUpstream": "https://mirror.example.com/dns-query",
+		"localDomains": ["lan"],
+		"localResolver": "192.0.2.53:53",
+		"staticHosts": {"dns.lan": "192.0.2.53", "router.nextdns.io": ["192.0.2.1", "192.0.2.2"]},
+		"trackHotNames": true,
+		"rebindingProtection": true,
+		"rebindingAllowlist": ["intranet.example.com"],
+		"authoritativeLocal": true,
+		"routerRefreshInterval": 600,
+		"raceBootstrap": true,
+		"startupBehavior": "servfail",
+		"startupTimeout": 2,
+		"networkRecovery": false,
+		"soaMName": "ns.lan.",
+		"soaRName": "admin.lan.",
+		"soaMinTTL": 60,
+		"maxNegativeTTL": 120,
+		"preferredRetryInterval": 30,
+		"preferredRetryMaxInterval": 300,
+		"idleTimeout": 120,
+		"forwardUnsupportedEDNS": true,
+		"maxInflight": 64,
+		"startBackoffThreshold": 3,
+		"startBackoffMax": 60,
+		"dscp": 46,
+		"statsdAddr": "127.0.0.1:8125",
+		"statsdPrefix": "dns.",
+		"statsdTags": ["site:office"],
+		"statsdFlushInterval": 5
+	}`
+	name, err := fileInDir(dir, "full.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(full), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := settings.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stg := settings.FromMap(m)
+	want := proxy.Options{
+		StripHTTPSRecords:   true,
+		RotateAnswers:       true,
+		MirrorUpstream:      "https://mirror.example.com/dns-query",
+		LocalDomains:        []string{"lan"},
+		LocalResolver:       "192.0.2.53:53",
+		StaticHosts:         map[string][]string{"dns.lan": {"192.0.2.53"}, "router.nextdns.io": {"192.0.2.1", "192.0.2.2"}},
+		RebindingProtection: true,
+		RebindingAllowlist:  []string{"intranet.example.com"},
+		AuthoritativeLocal:  true,
+		TrackHotNames:       true,
+
+		RouterRefreshInterval:     10 * time.Minute,
+		RaceBootstrap:             true,
+		StartupBehavior:           "servfail",
+		StartupTimeout:            2 * time.Second,
+		NetworkRecovery:           false,
+		SOA:                       proxy.SOA{MName: "ns.lan.", RName: "admin.lan.", MinTTL: 60},
+		MaxNegativeTTL:            2 * time.Minute,
+		PreferredRetryInterval:    30 * time.Second,
+		PreferredRetryMaxInterval: 5 * time.Minute,
+		IdleTimeout:               2 * time.Minute,
+		ForwardUnsupportedEDNS:    true,
+		MaxInflight:               64,
+		StartBackoffThreshold:     3,
+		StartBackoffMax:           time.Minute,
+		DSCP:                      46,
+	}
+	opts := proxyOptions(stg)
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("proxyOptions = %+v, want %+v", opts, want)
+	}
+	if err := (&proxy.Proxy{}).CheckOptions(opts); err != nil {
+		t.Errorf("CheckOptions = %v", err)
+	}
+	if !stg.Enabled || stg.Configuration != "abcdef" || stg.DeviceName != "office" || stg.CheckUpdates || stg.UpdateChannel != "beta" {
+		t.Errorf("service settings = %+v", stg)
+	}
+	if stg.StatsDAddr != "127.0.0.1:8125" || stg.StatsDPrefix != "dns." || !reflect.DeepEqual(stg.StatsDTags, []string{"site:office"}) || stg.StatsDFlushInterval != 5*time.Second {
+		t.Errorf("statsd settings = %+v", stg)
+	}
+
+	// A file with an invalid value is rejected as a whole, without quoting
+	// the file content.
+	invalid := strings.Replace(full, `"maxInflight": 64`, `"maxInflight": "secret-value"`, 1)
+	if err := ioutil.WriteFile(name, []byte(invalid), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settings.ReadFile(name); err == nil || strings.Contains(err.Error(), "secret-value") {
+		t.Errorf("ReadFile = %v, want an error not quoting the value", err)
+	}
+}
+
+func TestServiceArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"none", []string{"-service", "install"}, nil},
+		{"debug dropped", []string{"-debug", "-service", "install"}, nil},
+		{"flags kept", []string{"-service", "install", "-cpu-affinity", "0x3", "-stop-timeout=30s", "-upstream-allowlist=corp.example.com,nextdns.io"},
+			[]string{"-cpu-affinity=0x3", "-stop-timeout=30s", "-upstream-allowlist=corp.example.com,nextdns.io"}},
+		{"defaults kept when set", []string{"-summary-interval=0s", "-gui-path", `C:\Program Files\NextDNS\NextDNS.exe`, "-service", "install"},
+			[]string{`-gui-path=C:\Program Files\NextDNS\NextDNS.exe`, "-summary-interval=0s"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("service", flag.ContinueOnError)
+			fs.Bool("debug", false, "")
+			fs.String("service", "", "")
+			fs.Duration("stop-timeout", 0, "")
+			fs.String("cpu-affinity", "", "")
+			fs.String("upstream-allowlist", "", "")
+			fs.String("gui-path", "", "")
+			fs.Duration("summary-interval", 0, "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if got := serviceArgs(fs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("serviceArgs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package netchange
+
+import (
+	"context"
+	"time"
+)
+
+// debounce is the time to wait for the network configuration to settle before
+// notifying a change, as changes usually come in bursts.
+const debounce = 2 * time.Second
+
+// Watch calls onChange whenever the IP addresses of the system change, until
+// ctx is done.
+func Watch(ctx context.Context, onChange func()) error {
+	changes := make(chan struct{}, 1)
+	if err := watch(ctx, changes); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changes:
+			}
+			// Wait for the burst of changes to end.
+			t := time.NewTimer(debounce)
+		settle:
+			for {
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return
+				case <-changes:
+					t.Reset(debounce)
+				case <-t.C:
+					break settle
+				}
+			}
+			onChange()
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,12 @@
+//+build !windows
+
+package netchange
+
+import (
+	"context"
+	"errors"
+)
+
+func watch(ctx context.Context, changes chan<- struct{}) error {
+	return errors.New("not implemented")
+}
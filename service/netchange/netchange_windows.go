@@ -0,0 +1,65 @@
+package netchange
+
+import (
+	"context"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	iphlpapi                 = windows.NewLazySystemDLL("iphlpapi.dll")
+	procNotifyAddrChange     = iphlpapi.NewProc("NotifyAddrChange")
+	procCancelIPChangeNotify = iphlpapi.NewProc("CancelIPChangeNotify")
+)
+
+// waitTimeout is the interval, in milliseconds, at which the watcher checks if
+// it has to stop.
+const waitTimeout = 1000
+
+func watch(ctx context.Context, changes chan<- struct{}) error {
+	ev, err := windows.CreateEvent(nil, 0, 0, nil)
+	if err != nil {
+		return fmt.Errorf("CreateEvent: %v", err)
+	}
+	var o windows.Overlapped
+	o.HEvent = ev
+	if err := notifyAddrChange(&o); err != nil {
+		windows.CloseHandle(ev)
+		return err
+	}
+	go func() {
+		defer windows.CloseHandle(ev)
+		for {
+			ret, _ := windows.WaitForSingleObject(ev, waitTimeout)
+			select {
+			case <-ctx.Done():
+				_, _, _ = procCancelIPChangeNotify.Call(uintptr(unsafe.Pointer(&o)))
+				return
+			default:
+			}
+			if ret != windows.WAIT_OBJECT_0 {
+				continue
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+			// Notifications are one shot, register for the next one.
+			if err := notifyAddrChange(&o); err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func notifyAddrChange(o *windows.Overlapped) error {
+	var h windows.Handle
+	r, _, _ := procNotifyAddrChange.Call(uintptr(unsafe.Pointer(&h)), uintptr(unsafe.Pointer(o)))
+	if windows.Errno(r) != windows.ERROR_IO_PENDING {
+		return fmt.Errorf("NotifyAddrChange: %v", windows.Errno(r))
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// serviceDir returns the directory named sub next to the executable. The
+// files the ctl commands read or write are confined to such directories.
+func serviceDir(sub string) string {
+	ex, _ := os.Executable()
+	return filepath.Join(filepath.Dir(ex), sub)
+}
+
+// fileInDir returns the path of the file name in dir. Only plain file names
+// are accepted, rejecting absolute, UNC and relative paths: the ctl pipe is
+// open to all local users while the service runs as SYSTEM, so it must not
+// read or write files elsewhere, nor authenticate to a remote share.
+func fileInDir(dir, name string) (string, error) {
+	if name == "" {
+		return "", errors.New("no file name")
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\:`) {
+		return "", fmt.Errorf("invalid file %q: must be a file name", name)
+	}
+	return filepath.Join(dir, name), nil
+}
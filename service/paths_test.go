@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFileInDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"support.json", false},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{"../support.json", true},
+		{`..\support.json`, true},
+		{`C:\Windows\support.json`, true},
+		{"C:support.json", true},
+		{"/etc/support.json", true},
+		{`\\server\share\support.json`, true},
+		{"//server/share/support.json", true},
+	}
+	for _, tt := range tests {
+		path, err := fileInDir("config", tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("fileInDir(%q) = %q, %v, want error %v", tt.name, path, err, tt.wantErr)
+		}
+		if err == nil && filepath.Dir(path) != "config" {
+			t.Errorf("fileInDir(%q) = %q, outside of the directory", tt.name, path)
+		}
+	}
+}
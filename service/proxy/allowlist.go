@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// checkUpstream returns an error if the host of the upstream u, either a URL
+// or a host with an optional port, does not match AllowedUpstreams.
+func (p *Proxy) checkUpstream(u string) error {
+	if u == "" || len(p.AllowedUpstreams) == 0 {
+		return nil
+	}
+	host := u
+	if strings.Contains(u, "://") {
+		pu, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("invalid upstream %s: %v", u, err)
+		}
+		host = pu.Hostname()
+	} else if h, _, err := net.SplitHostPort(u); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) != nil {
+		// IP addresses must be listed as is.
+		for _, a := range p.AllowedUpstreams {
+			if a == host {
+				return nil
+			}
+		}
+	} else if matchDomain(host, p.AllowedUpstreams) {
+		return nil
+	}
+	return fmt.Errorf("upstream %s not allowed: %s does not match %s", u, host, strings.Join(p.AllowedUpstreams, ","))
+}
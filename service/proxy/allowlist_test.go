@@ -0,0 +1,43 @@
+package proxy
+
+import "testing"
+
+func TestCheckUpstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		u       string
+		wantErr bool
+	}{
+		{"no allowlist", nil, "https://evil.example.net/abcdef", false},
+		{"empty upstream", []string{"nextdns.io"}, "", false},
+		{"url allowed", []string{"nextdns.io"}, "https://dns.nextdns.io/abcdef", false},
+		{"url disallowed", []string{"nextdns.io"}, "https://evil.example.net/abcdef", true},
+		{"suffix not domain", []string{"nextdns.io"}, "https://evilnextdns.io/abcdef", true},
+		{"host port allowed", []string{"lan"}, "router.lan:53", false},
+		{"ip allowed", []string{"192.168.1.1"}, "192.168.1.1:53", false},
+		{"ip disallowed", []string{"192.168.1.1"}, "192.168.1.2:53", true},
+		{"invalid url", []string{"nextdns.io"}, "https://%zz/", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{AllowedUpstreams: tt.allowed}
+			if err := p.checkUpstream(tt.u); (err != nil) != tt.wantErr {
+				t.Errorf("checkUpstream(%q) = %v, want error %v", tt.u, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckOptionsAllowedUpstreams(t *testing.T) {
+	p := &Proxy{AllowedUpstreams: []string{"nextdns.io"}}
+	if err := p.SetOptions(Options{MirrorUpstream: "https://evil.example.net/abcdef"}); err == nil {
+		t.Error("disallowed mirror upstream accepted")
+	}
+	if err := p.SetOptions(Options{LocalResolver: "10.0.0.1:53"}); err == nil {
+		t.Error("disallowed local resolver accepted")
+	}
+	if err := p.SetOptions(Options{MirrorUpstream: "https://dns.nextdns.io/abcdef"}); err != nil {
+		t.Errorf("allowed mirror upstream rejected: %v", err)
+	}
+}
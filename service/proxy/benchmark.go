@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Bounds of the benchmarks run with Benchmark.
+const (
+	DefaultBenchmarkQueries = 50
+	MaxBenchmarkQueries     = 1000
+	benchmarkTimeout        = 30 * time.Second
+)
+
+// DefaultBenchmarkNames are the names queried by Benchmark when none is
+// given.
+var DefaultBenchmarkNames = []string{
+	"google.com.",
+	"facebook.com.",
+	"amazon.com.",
+	"microsoft.com.",
+	"wikipedia.org.",
+}
+
+// BenchmarkResult holds the aggregated results of Benchmark.
+type BenchmarkResult struct {
+	Queries   int // number of queries sent
+	Errors    int // queries which failed or got a SERVFAIL
+	Min       time.Duration
+	Avg       time.Duration
+	P95       time.Duration
+	Max       time.Duration
+	TimedOut  bool // the benchmark was stopped before sending all queries
+	Truncated bool // count was capped to MaxBenchmarkQueries
+}
+
+// Benchmark sends count queries for names in turn through the same path as
+// the queries received from the system and reports their latency. If count is
+// not positive, DefaultBenchmarkQueries is used and if names is empty,
+// DefaultBenchmarkNames. The benchmark is capped to MaxBenchmarkQueries
+// queries and 30 seconds, and a single benchmark runs at a time so they do
+// not add up to a load on the upstream.
+func (p *Proxy) Benchmark(ctx context.Context, names []string, count int) (BenchmarkResult, error) {
+	var r BenchmarkResult
+	if p.State() != StateStarted {
+		return r, errors.New("proxy not started")
+	}
+	if !atomic.CompareAndSwapInt32(&p.benchmarking, 0, 1) {
+		return r, errors.New("benchmark already running")
+	}
+	defer atomic.StoreInt32(&p.benchmarking, 0)
+	if len(names) == 0 {
+		names = DefaultBenchmarkNames
+	}
+	if count <= 0 {
+		count = DefaultBenchmarkQueries
+	}
+	if count > MaxBenchmarkQueries {
+		count = MaxBenchmarkQueries
+		r.Truncated = true
+	}
+	packets := make([][]byte, 0, len(names))
+	for _, name := range names {
+		q, err := testQuery(name)
+		if err != nil {
+			return r, err
+		}
+		packets = append(packets, queryPacket(q))
+	}
+	ctx, cancel := context.WithTimeout(ctx, benchmarkTimeout)
+	defer cancel()
+	latencies := make([]time.Duration, 0, count)
+	buf := make([]byte, 1500)
+	for i := 0; i < count; i++ {
+		if ctx.Err() != nil {
+			r.TimedOut = true
+			break
+		}
+		pkt := packets[i%len(packets)]
+		buf = buf[:copy(buf[:cap(buf)], pkt)]
+		traceID := atomic.AddUint32(&p.traceSeq, 1)
+		start := time.Now()
+		rsize, err := p.handleQuery(ctx, traceID, lazyMsgID(buf), buf)
+		d := time.Since(start)
+		r.Queries++
+		if err != nil {
+			r.Errors++
+			continue
+		}
+		if res := dnsMessage(buf[:rsize]); res == nil || res[3]&0xf == rcodeServFail {
+			r.Errors++
+			continue
+		}
+		latencies = append(latencies, d)
+	}
+	if len(latencies) == 0 {
+		return r, nil
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, d := range latencies {
+		total += d
+	}
+	r.Min = latencies[0]
+	r.Avg = total / time.Duration(len(latencies))
+	r.P95 = latencies[(len(latencies)*95+99)/100-1]
+	r.Max = latencies[len(latencies)-1]
+	return r, nil
+}
+
+// queryPacket wraps the DNS message q in an IPv4 UDP packet as received from
+// the tun interface.
+func queryPacket(q []byte) []byte {
+	udpLen := 8 + len(q)
+	ipLen := 20 + udpLen
+	pkt := []byte{
+		0x45, 0, byte(ipLen >> 8), byte(ipLen), // version, IHL, total length
+		0, 0, 0, 0, // identification, flags
+		64, 17, 0, 0, // TTL, protocol UDP, checksum
+		192, 0, 2, 43, // source
+		192, 0, 2, 42, // destination
+		0xc3, 0x50, 0, 53, // source port 50000, destination port 53
+		byte(udpLen >> 8), byte(udpLen), 0, 0, // length, no checksum
+	}
+	setIPChecksum(pkt)
+	return append(pkt, q...)
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBenchmarkSingleRun(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	p, _ := testProxy(t, Options{}, func(q []byte) []byte {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return answerA(q, "192.0.2.1")
+	})
+	p.state = StateStarted
+
+	done := make(chan error, 1)
+	go func() {
+		r, err := p.Benchmark(context.Background(), nil, 2)
+		if err == nil && (r.Queries != 2 || r.Errors != 0) {
+			t.Errorf("first benchmark = %+v, want 2 queries without error", r)
+		}
+		done <- err
+	}()
+	<-started
+	if _, err := p.Benchmark(context.Background(), nil, 1); err == nil {
+		t.Error("concurrent benchmark accepted")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("first benchmark: %v", err)
+	}
+	if _, err := p.Benchmark(context.Background(), nil, 1); err != nil {
+		t.Errorf("benchmark after the first one completed: %v", err)
+	}
+}
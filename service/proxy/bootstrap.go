@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// routerHostname is the hostname of the NextDNS router API.
+const routerHostname = "router.nextdns.io"
+
+// routerBootstrapIPs are the IPs serving router.nextdns.io, used to contact the
+// router API without depending on DNS.
+var routerBootstrapIPs = []string{
+	"216.239.32.21",
+	"216.239.34.21",
+	"216.239.36.21",
+	"216.239.38.21",
+}
+
+// bootstrapRaceTimeout is the maximum time spent racing bootstrap IPs before
+// falling back to a random one.
+const bootstrapRaceTimeout = 2 * time.Second
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// raceBootstrap connects to all the router bootstrap IPs using dial and keeps
+// the fastest one for the transports created next, when Options RaceBootstrap
+// is set. Otherwise, or if the race fails, IPs are picked randomly. The race is
+// skipped when a static host is defined for the router as it overrides the
+// bootstrap IP anyway.
+func (p *Proxy) raceBootstrap(dial dialFunc) {
+	var ip string
+	if p.options().RaceBootstrap && len(p.staticHost(routerHostname)) == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), bootstrapRaceTimeout)
+		defer cancel()
+		var err error
+		if ip, err = fastestIP(ctx, routerBootstrapIPs, "443", dial); err == nil {
+			p.logInfo(fmt.Sprintf("Bootstrap: using fastest router IP %s", ip))
+		} else {
+			p.logErr(fmt.Errorf("bootstrap race: %v", err))
+		}
+	}
+	p.bootstrapMu.Lock()
+	defer p.bootstrapMu.Unlock()
+	p.fastestRouterIP = ip
+}
+
+// routerBootstrapIP returns the IP to use to contact the router API: the IP
+// defined in StaticHosts if any, the fastest IP found by raceBootstrap, or a
+// random IP to spread the load.
+func (p *Proxy) routerBootstrapIP() string {
+	if ips := p.staticHost(routerHostname); len(ips) > 0 {
+		return ips[0]
+	}
+	p.bootstrapMu.Lock()
+	ip := p.fastestRouterIP
+	p.bootstrapMu.Unlock()
+	if ip != "" {
+		return ip
+	}
+	return routerBootstrapIPs[rand.Intn(len(routerBootstrapIPs))]
+}
+
+// fastestIP connects to all ips on port concurrently and returns the first one
+// to successfully connect.
+func fastestIP(ctx context.Context, ips []string, port string, dial dialFunc) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		ip  string
+		err error
+	}
+	results := make(chan result, len(ips))
+	for _, ip := range ips {
+		go func(ip string) {
+			c, err := dial(ctx, "tcp", net.JoinHostPort(ip, port))
+			if err == nil {
+				c.Close()
+			}
+			results <- result{ip, err}
+		}(ip)
+	}
+	var err error
+	for range ips {
+		r := <-results
+		if r.err == nil {
+			return r.ip, nil
+		}
+		err = r.err
+	}
+	return "", err
+}
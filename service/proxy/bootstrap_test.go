@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDial returns a dialFunc connecting to each IP after its delay, or
+// failing if its delay is negative.
+func fakeDial(delays map[string]time.Duration) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		delay := delays[host]
+		if delay < 0 {
+			return nil, errors.New("connection refused")
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}
+}
+
+func TestFastestIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		delays  map[string]time.Duration
+		want    string
+		wantErr bool
+	}{
+		{"fastest wins", map[string]time.Duration{
+			"192.0.2.1": 200 * time.Millisecond,
+			"192.0.2.2": 0,
+			"192.0.2.3": 100 * time.Millisecond,
+		}, "192.0.2.2", false},
+		{"failures ignored", map[string]time.Duration{
+			"192.0.2.1": -1,
+			"192.0.2.2": 100 * time.Millisecond,
+			"192.0.2.3": -1,
+		}, "192.0.2.2", false},
+		{"all fail", map[string]time.Duration{
+			"192.0.2.1": -1,
+			"192.0.2.2": -1,
+		}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ips []string
+			for ip := range tt.delays {
+				ips = append(ips, ip)
+			}
+			got, err := fastestIP(context.Background(), ips, "443", fakeDial(tt.delays))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("fastestIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRaceBootstrap(t *testing.T) {
+	fastest := routerBootstrapIPs[2]
+	delays := map[string]time.Duration{}
+	for _, ip := range routerBootstrapIPs {
+		delays[ip] = 300 * time.Millisecond
+	}
+	delays[fastest] = 0
+	tests := []struct {
+		name      string
+		opts      Options
+		wantRace  bool
+		wantIP    string
+		wantOneOf []string
+	}{
+		{"disabled", Options{}, false, "", routerBootstrapIPs},
+		{"enabled", Options{RaceBootstrap: true}, true, fastest, nil},
+		{"static host", Options{
+			RaceBootstrap: true,
+			StaticHosts:   map[string][]string{"router.nextdns.io": {"192.0.2.10"}},
+		}, false, "192.0.2.10", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{}
+			if err := p.SetOptions(tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			var mu sync.Mutex
+			var dials int
+			dial := fakeDial(delays)
+			p.raceBootstrap(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				mu.Lock()
+				dials++
+				mu.Unlock()
+				return dial(ctx, network, addr)
+			})
+			mu.Lock()
+			raced := dials > 0
+			mu.Unlock()
+			if raced != tt.wantRace {
+				t.Errorf("raced = %v, want %v", raced, tt.wantRace)
+			}
+			got := p.routerBootstrapIP()
+			if tt.wantIP != "" && got != tt.wantIP {
+				t.Errorf("routerBootstrapIP = %q, want %q", got, tt.wantIP)
+			}
+			if tt.wantOneOf != nil {
+				found := false
+				for _, ip := range tt.wantOneOf {
+					found = found || ip == got
+				}
+				if !found {
+					t.Errorf("routerBootstrapIP = %q, want one of %v", got, tt.wantOneOf)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"errors"
+	"time"
+)
+
+// clockSkewReportInterval is the minimum interval between two calls to
+// OnClockSkew.
+const clockSkewReportInterval = 10 * time.Minute
+
+// isClockSkewError returns true if err is caused by a certificate outside of
+// its validity period, which usually means the system clock is wrong rather
+// than the endpoint being broken.
+func isClockSkewError(err error) bool {
+	var certErr x509.CertificateInvalidError
+	return errors.As(err, &certErr) && certErr.Reason == x509.Expired
+}
+
+// checkClockSkew calls OnClockSkew if err is a clock skew error and it was not
+// reported recently.
+func (p *Proxy) checkClockSkew(err error) {
+	if p.OnClockSkew == nil || !isClockSkewError(err) {
+		return
+	}
+	p.clockSkewMu.Lock()
+	report := time.Since(p.lastClockSkew) >= clockSkewReportInterval
+	if report {
+		p.lastClockSkew = time.Now()
+	}
+	p.clockSkewMu.Unlock()
+	if report {
+		p.OnClockSkew(err)
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// certValidFrom returns a self-signed certificate for example.com valid from
+// notBefore for a day.
+func certValidFrom(t *testing.T, notBefore time.Time) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "example.com"},
+		DNSNames:              []string{"example.com"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClockSkew(t *testing.T) {
+	tests := []struct {
+		name       string
+		notBefore  time.Time
+		wantReport bool
+	}{
+		{"not yet valid", time.Now().Add(48 * time.Hour), true},
+		{"expired", time.Now().Add(-48 * time.Hour), true},
+		{"valid", time.Now().Add(-time.Hour), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := certValidFrom(t, tt.notBefore)
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+			srv.StartTLS()
+			defer srv.Close()
+			roots := x509.NewCertPool()
+			roots.AddCert(cert.Leaf)
+			cp := &connPool{rootCAs: roots}
+			req, _ := http.NewRequest("GET", "https://example.com/", nil)
+			res, err := cp.roundTrip("example.com", srv.Listener.Addr().String(), "", req)
+			if err == nil {
+				res.Body.Close()
+			}
+
+			var reports []error
+			p := &Proxy{OnClockSkew: func(err error) { reports = append(reports, err) }}
+			// Errors are reported wrapped like the endpoint failures are.
+			p.checkClockSkew(fmt.Errorf("endpoint failed: %w", err))
+			p.checkClockSkew(err)
+			want := 0
+			if tt.wantReport {
+				want = 1 // the second one is rate limited
+			}
+			if len(reports) != want {
+				t.Errorf("%d clock skew reports for %v, want %d", len(reports), err, want)
+			}
+		})
+	}
+	if isClockSkewError(errors.New("x509: certificate signed by unknown authority")) {
+		t.Error("unrelated error reported as clock skew")
+	}
+}
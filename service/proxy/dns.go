@@ -0,0 +1,468 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+)
+
+// DNS response codes used by locally generated responses.
+const (
+	rcodeNoError  = 0
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+	rcodeRefused  = 5
+	rcodeBadVers  = 16 // extended rcode, carried by the OPT record
+)
+
+// DNS record types handled explicitly.
+const (
+	typeA     = 1
+	typeSOA   = 6
+	typeAAAA  = 28
+	typeOPT   = 41
+	typeHTTPS = 65
+)
+
+// DNS opcodes handled explicitly.
+const (
+	opcodeQuery  = 0
+	opcodeNotify = 4
+	opcodeUpdate = 5
+)
+
+// dnsHeaderSize is the size of a DNS message header.
+const dnsHeaderSize = 12
+
+var errInvalidMessage = errors.New("invalid DNS message")
+
+// dnsMessage returns the DNS message carried by the UDP query packet buf
+// received from the tun interface.
+func dnsMessage(buf []byte) []byte {
+	if len(buf) < 28+dnsHeaderSize {
+		return nil
+	}
+	return buf[28:]
+}
+
+// responsePacket turns the query packet buf, which DNS message was replaced
+// by a response of n bytes, into the response packet by swapping its addresses
+// and ports and updating its lengths and checksum. The size of the packet is
+// returned.
+func responsePacket(buf []byte, n int) int {
+	for i := 12; i < 16; i++ {
+		buf[i], buf[i+4] = buf[i+4], buf[i] // source and destination IPs
+	}
+	buf[20], buf[21], buf[22], buf[23] = buf[22], buf[23], buf[20], buf[21] // ports
+	return resizePacket(buf, n)
+}
+
+// resizePacket updates the lengths and checksum of the packet buf which DNS
+// message was replaced by one of n bytes. The size of the packet is returned.
+func resizePacket(buf []byte, n int) int {
+	buf = buf[:28+n]
+	ipLen, udpLen := len(buf), len(buf)-20
+	buf[2], buf[3] = byte(ipLen>>8), byte(ipLen)
+	buf[24], buf[25] = byte(udpLen>>8), byte(udpLen)
+	buf[26], buf[27] = 0, 0 // no UDP checksum
+	setIPChecksum(buf)
+	return len(buf)
+}
+
+// setIPChecksum computes the checksum of the 20 bytes IPv4 header of pkt.
+func setIPChecksum(pkt []byte) {
+	pkt[10], pkt[11] = 0, 0
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(pkt[i])<<8 | uint32(pkt[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	pkt[10], pkt[11] = ^byte(sum>>8), ^byte(sum)
+}
+
+// opcode returns the opcode of msg.
+func opcode(msg []byte) int {
+	return int(msg[2]>>3) & 0xf
+}
+
+// skipName returns the offset following the name starting at off in msg.
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return -1, errInvalidMessage
+		}
+		c := int(msg[off])
+		switch c & 0xc0 {
+		case 0x00:
+			if c == 0 {
+				return off + 1, nil
+			}
+			off += 1 + c
+		case 0xc0:
+			// Compression pointer, the name ends here.
+			if off+2 > len(msg) {
+				return -1, errInvalidMessage
+			}
+			return off + 2, nil
+		default:
+			return -1, errInvalidMessage
+		}
+	}
+}
+
+// questionEnd returns the offset following the first question of msg.
+func questionEnd(msg []byte) (int, error) {
+	if len(msg) < dnsHeaderSize || msg[4] != 0 || msg[5] != 1 {
+		return -1, errInvalidMessage
+	}
+	off, err := skipName(msg, dnsHeaderSize)
+	if err != nil {
+		return -1, err
+	}
+	off += 4 // qtype + qclass
+	if off > len(msg) {
+		return -1, errInvalidMessage
+	}
+	return off, nil
+}
+
+// questionType returns the type of the first question of msg.
+func questionType(msg []byte) (uint16, error) {
+	end, err := questionEnd(msg)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(msg[end-4])<<8 | uint16(msg[end-3]), nil
+}
+
+// emptyResponse returns a response to the query q with the given rcode and no
+// records. The question is copied from q when valid.
+func emptyResponse(q []byte, rcode int) []byte {
+	if len(q) < dnsHeaderSize {
+		return nil
+	}
+	end, err := questionEnd(q)
+	if err != nil {
+		end = dnsHeaderSize
+	}
+	res := make([]byte, end)
+	copy(res, q[:end])
+	res[2] = 0x80 | res[2]&0x79     // QR, keep opcode and RD, clear AA and TC
+	res[3] = 0x80 | byte(rcode&0xf) // RA
+	if end == dnsHeaderSize {
+		res[4], res[5] = 0, 0
+	}
+	// Clear answer, authority and additional counts.
+	for i := 6; i < dnsHeaderSize; i++ {
+		res[i] = 0
+	}
+	return res
+}
+
+// setResponseFlags sets the flags expected from a recursive forwarder on the
+// response msg: RA is set as queries are recursed through NextDNS and RD is
+// copied from the query. Servers forwarding to the proxy may otherwise reject
+// or mistreat the response.
+func setResponseFlags(msg []byte, rd bool) {
+	if len(msg) < dnsHeaderSize {
+		return
+	}
+	msg[2] &^= 0x01
+	if rd {
+		msg[2] |= 0x01
+	}
+	msg[3] |= 0x80
+}
+
+// setAuthoritative sets the AA flag of the response msg.
+func setAuthoritative(msg []byte) {
+	if len(msg) >= dnsHeaderSize {
+		msg[2] |= 0x04
+	}
+}
+
+// SOA defines the SOA record added to the authority section of locally
+// generated negative responses so clients cache them properly.
+type SOA struct {
+	// MName is the primary name server. If empty, DefaultSOA.MName is used.
+	MName string
+
+	// RName is the mailbox of the person responsible. If empty,
+	// DefaultSOA.RName is used.
+	RName string
+
+	// MinTTL is the minimum TTL field, used by clients as the negative
+	// caching TTL. It is also used as the TTL of the record. If zero,
+	// DefaultSOA.MinTTL is used.
+	MinTTL uint32
+}
+
+// DefaultSOA defines the default value for Options SOA.
+var DefaultSOA = SOA{
+	MName:  "localhost.",
+	RName:  "nobody.invalid.",
+	MinTTL: 60,
+}
+
+func (s SOA) withDefaults() SOA {
+	if s.MName == "" {
+		s.MName = DefaultSOA.MName
+	}
+	if s.RName == "" {
+		s.RName = DefaultSOA.RName
+	}
+	if s.MinTTL == 0 {
+		s.MinTTL = DefaultSOA.MinTTL
+	}
+	return s
+}
+
+// negativeResponse returns a response to the query q with rcode and no
+// answer, with a SOA record for the queried name in the authority section.
+func negativeResponse(q []byte, rcode int, soa SOA) []byte {
+	res := emptyResponse(q, rcode)
+	if len(res) == dnsHeaderSize {
+		// No valid question to attach the SOA to.
+		return res
+	}
+	soa = soa.withDefaults()
+	rr := []byte{
+		0xc0, dnsHeaderSize, // pointer to the question name
+		0, typeSOA, 0, 1, // type, class IN
+		byte(soa.MinTTL >> 24), byte(soa.MinTTL >> 16), byte(soa.MinTTL >> 8), byte(soa.MinTTL),
+		0, 0, // rdlength, set below
+	}
+	rdOff := len(rr)
+	var err error
+	if rr, err = appendName(rr, soa.MName); err != nil {
+		return res
+	}
+	if rr, err = appendName(rr, soa.RName); err != nil {
+		return res
+	}
+	for _, v := range []uint32{1, 3600, 600, 86400, soa.MinTTL} { // serial, refresh, retry, expire, minimum
+		rr = append(rr, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	rdlen := len(rr) - rdOff
+	rr[rdOff-2], rr[rdOff-1] = byte(rdlen>>8), byte(rdlen)
+	res = append(res, rr...)
+	res[9] = 1 // NSCOUNT
+	return res
+}
+
+// ednsVersionSupported is the highest EDNS version understood.
+const ednsVersionSupported = 0
+
+// ednsUDPSize is the UDP payload size advertised in locally generated OPT
+// records.
+const ednsUDPSize = 1232
+
+// ednsVersion returns the EDNS version of the OPT record of msg. If msg has
+// no OPT record, ok is false.
+func ednsVersion(msg []byte) (version int, ok bool) {
+	_, _, ar, err := sections(msg)
+	if err != nil {
+		return 0, false
+	}
+	for _, r := range ar {
+		if r.typ == typeOPT {
+			// The TTL field holds the extended rcode, version and flags.
+			return int(msg[r.rdOff-5]), true
+		}
+	}
+	return 0, false
+}
+
+// badVersResponse returns a BADVERS response to q as defined by RFC 6891, with
+// an OPT record advertising the supported EDNS version.
+func badVersResponse(q []byte) []byte {
+	res := emptyResponse(q, rcodeBadVers)
+	if res == nil {
+		return nil
+	}
+	res = append(res,
+		0,          // root name
+		0, typeOPT, // type
+		byte(ednsUDPSize>>8), byte(ednsUDPSize&0xff), // class: UDP payload size
+		byte(rcodeBadVers>>4), ednsVersionSupported, 0, 0, // ttl: extended rcode, version, flags
+		0, 0, // rdlength
+	)
+	res[11] = 1 // ARCOUNT
+	return res
+}
+
+// appendName appends the wire format of the fully qualified name to b.
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, l := range strings.Split(name, ".") {
+			if len(l) == 0 || len(l) > 63 {
+				return nil, errInvalidMessage
+			}
+			b = append(b, byte(len(l)))
+			b = append(b, l...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// resource locates a resource record within a message.
+type resource struct {
+	off   int // start of the record
+	end   int // end of the record
+	typ   uint16
+	rdOff int // start of the record data
+
+	// ptrName is true when the owner name is a single compression pointer,
+	// in which case no other name can point inside the record, unless it
+	// holds a name in its data.
+	ptrName bool
+}
+
+// ttlOff returns the offset of the TTL of r.
+func (r resource) ttlOff() int {
+	return r.rdOff - 6
+}
+
+// sections returns the records of the answer, authority and additional
+// sections of msg.
+func sections(msg []byte) (an, ns, ar []resource, err error) {
+	if len(msg) < dnsHeaderSize {
+		return nil, nil, nil, errInvalidMessage
+	}
+	count := func(i int) int {
+		return int(msg[i])<<8 | int(msg[i+1])
+	}
+	off := dnsHeaderSize
+	for i := count(4); i > 0; i-- {
+		if off, err = skipName(msg, off); err != nil {
+			return nil, nil, nil, err
+		}
+		off += 4
+	}
+	parse := func(n int) ([]resource, error) {
+		rrs := make([]resource, 0, n)
+		for ; n > 0; n-- {
+			r := resource{off: off}
+			nameEnd, err := skipName(msg, off)
+			if err != nil {
+				return nil, err
+			}
+			r.ptrName = nameEnd == off+2 && msg[off]&0xc0 == 0xc0
+			r.rdOff = nameEnd + 10 // type, class, ttl, rdlength
+			if r.rdOff > len(msg) {
+				return nil, errInvalidMessage
+			}
+			r.typ = uint16(msg[nameEnd])<<8 | uint16(msg[nameEnd+1])
+			r.end = r.rdOff + (int(msg[nameEnd+8])<<8 | int(msg[nameEnd+9]))
+			if r.end > len(msg) {
+				return nil, errInvalidMessage
+			}
+			rrs = append(rrs, r)
+			off = r.end
+		}
+		return rrs, nil
+	}
+	if an, err = parse(count(6)); err != nil {
+		return nil, nil, nil, err
+	}
+	if ns, err = parse(count(8)); err != nil {
+		return nil, nil, nil, err
+	}
+	if ar, err = parse(count(10)); err != nil {
+		return nil, nil, nil, err
+	}
+	return an, ns, ar, nil
+}
+
+// rotateAnswers rotates by n positions each run of consecutive A or AAAA
+// records of the answer section of msg, in place. Records with an owner name
+// other than a compression pointer are left untouched as other names could
+// point inside them.
+func rotateAnswers(msg []byte, n int) error {
+	an, _, _, err := sections(msg)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(an); {
+		j := i
+		for j < len(an) && an[j].ptrName && (an[j].typ == typeA || an[j].typ == typeAAAA) && an[j].typ == an[i].typ {
+			j++
+		}
+		if j-i > 1 {
+			rotateRun(msg, an[i:j], n)
+		}
+		if j == i {
+			j++
+		}
+		i = j
+	}
+	return nil
+}
+
+func rotateRun(msg []byte, run []resource, n int) {
+	start, end := run[0].off, run[len(run)-1].end
+	rotated := make([]byte, 0, end-start)
+	for k := range run {
+		r := run[(k+n)%len(run)]
+		rotated = append(rotated, msg[r.off:r.end]...)
+	}
+	copy(msg[start:end], rotated)
+}
+
+// isBlockedResponse returns true if msg is a NextDNS response for a blocked
+// name, which by default answers with the unspecified address.
+func isBlockedResponse(msg []byte) bool {
+	an, _, _, err := sections(msg)
+	if err != nil || len(an) == 0 {
+		return false
+	}
+	for _, r := range an {
+		switch r.typ {
+		case typeA, typeAAAA:
+			for _, b := range msg[r.rdOff:r.end] {
+				if b != 0 {
+					return false
+				}
+			}
+		}
+	}
+	// Only consider responses with at least one address, all unspecified.
+	for _, r := range an {
+		if r.typ == typeA || r.typ == typeAAAA {
+			return true
+		}
+	}
+	return false
+}
+
+// capNegativeTTL caps to max the TTL and minimum field of the SOA records of
+// msg, in place, if msg is a negative (NXDOMAIN or NODATA) response. Clients
+// use them to determine how long a negative response is cached.
+func capNegativeTTL(msg []byte, max uint32) error {
+	an, ns, _, err := sections(msg)
+	if err != nil {
+		return err
+	}
+	rcode := msg[3] & 0xf
+	if rcode != rcodeNXDomain && (rcode != rcodeNoError || len(an) > 0) {
+		return nil
+	}
+	for _, r := range ns {
+		if r.typ != typeSOA || r.end-r.rdOff < 20 {
+			continue
+		}
+		capUint32(msg[r.ttlOff():], max)
+		capUint32(msg[r.end-4:], max) // minimum
+	}
+	return nil
+}
+
+func capUint32(b []byte, max uint32) {
+	v := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	if v > max {
+		b[0], b[1], b[2], b[3] = byte(max>>24), byte(max>>16), byte(max>>8), byte(max)
+	}
+}
@@ -0,0 +1,387 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+)
+
+// mkQuery returns a query message for name and qtype with the RD flag set.
+// If edns is not negative, an OPT record with this EDNS version is added.
+func mkQuery(t *testing.T, name string, qtype uint16, edns int) []byte {
+	t.Helper()
+	q := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	q, err := appendName(q, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q = append(q, byte(qtype>>8), byte(qtype), 0, 1)
+	if edns >= 0 {
+		q = append(q, 0, 0, typeOPT, 0x10, 0, 0, byte(edns), 0, 0, 0, 0)
+		q[11] = 1
+	}
+	return q
+}
+
+// ipChecksumValid returns true if the IPv4 header checksum of pkt is valid.
+func ipChecksumValid(pkt []byte) bool {
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(pkt[i])<<8 | uint32(pkt[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return sum == 0xffff
+}
+
+// checkResponsePacket checks pkt is a valid response packet to a query sent
+// by queryPacket and returns its DNS message.
+func checkResponsePacket(t *testing.T, pkt []byte) []byte {
+	t.Helper()
+	if len(pkt) < 28+dnsHeaderSize {
+		t.Fatalf("response packet too short: %d bytes", len(pkt))
+	}
+	if !bytes.Equal(pkt[12:16], []byte{192, 0, 2, 42}) || !bytes.Equal(pkt[16:20], []byte{192, 0, 2, 43}) {
+		t.Errorf("addresses not swapped: src %v dst %v", pkt[12:16], pkt[16:20])
+	}
+	if !bytes.Equal(pkt[20:24], []byte{0, 53, 0xc3, 0x50}) {
+		t.Errorf("ports not swapped: %v", pkt[20:24])
+	}
+	if ipLen := int(pkt[2])<<8 | int(pkt[3]); ipLen != len(pkt) {
+		t.Errorf("IP length = %d, want %d", ipLen, len(pkt))
+	}
+	if udpLen := int(pkt[24])<<8 | int(pkt[25]); udpLen != len(pkt)-20 {
+		t.Errorf("UDP length = %d, want %d", udpLen, len(pkt)-20)
+	}
+	if !ipChecksumValid(pkt) {
+		t.Error("invalid IP checksum")
+	}
+	return pkt[28:]
+}
+
+func rcode(msg []byte) int {
+	return int(msg[3] & 0xf)
+}
+
+func count(msg []byte, i int) int {
+	return int(msg[i])<<8 | int(msg[i+1])
+}
+
+func TestResponsePacket(t *testing.T) {
+	tests := []struct {
+		name string
+		res  []byte
+	}{
+		{"shorter than query", emptyResponse(mkQuery(t, "example.com", typeA, 0), rcodeServFail)},
+		{"longer than query", negativeResponse(mkQuery(t, "example.com", typeA, -1), rcodeNXDomain, SOA{})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, 0, 1500)
+			buf = append(buf, queryPacket(mkQuery(t, "example.com", typeA, -1))...)
+			n := responsePacket(buf, copy(buf[28:cap(buf)], tt.res))
+			msg := checkResponsePacket(t, buf[:n])
+			if !bytes.Equal(msg, tt.res) {
+				t.Errorf("DNS message = %x, want %x", msg, tt.res)
+			}
+		})
+	}
+}
+
+func TestEmptyResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		q         []byte
+		rcode     int
+		wantLen   int
+		wantQDCnt int
+	}{
+		{"question copied", mkQuery(t, "example.com", typeA, -1), rcodeServFail, 29, 1},
+		{"additional dropped", mkQuery(t, "example.com", typeA, 0), rcodeRefused, 29, 1},
+		{"invalid question", []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 5, 'a'}, rcodeNotImp, dnsHeaderSize, 0},
+		{"header only", []byte{0x12, 0x34, 0x01, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}, rcodeServFail, dnsHeaderSize, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := emptyResponse(tt.q, tt.rcode)
+			if len(res) != tt.wantLen {
+				t.Fatalf("len = %d, want %d", len(res), tt.wantLen)
+			}
+			if res[0] != 0x12 || res[1] != 0x34 {
+				t.Errorf("ID not copied: %x", res[:2])
+			}
+			if res[2]&0x80 == 0 || res[2]&0x01 == 0 || res[2]&0x06 != 0 {
+				t.Errorf("flags = %08b, want QR and RD only", res[2])
+			}
+			if rcode(res) != tt.rcode {
+				t.Errorf("rcode = %d, want %d", rcode(res), tt.rcode)
+			}
+			if count(res, 4) != tt.wantQDCnt {
+				t.Errorf("QDCOUNT = %d, want %d", count(res, 4), tt.wantQDCnt)
+			}
+			for i := 6; i < dnsHeaderSize; i += 2 {
+				if count(res, i) != 0 {
+					t.Errorf("count at %d = %d, want 0", i, count(res, i))
+				}
+			}
+		})
+	}
+	if res := emptyResponse([]byte{1, 2, 3}, rcodeServFail); res != nil {
+		t.Errorf("short query: got %x, want nil", res)
+	}
+}
+
+// appendAnswer appends to msg an answer record of type typ with rdata, owned
+// by the question name if ptr is set or by the root name otherwise.
+func appendAnswer(msg []byte, ptr bool, typ uint16, rdata ...byte) []byte {
+	if ptr {
+		msg = append(msg, 0xc0, dnsHeaderSize)
+	} else {
+		msg = append(msg, 0)
+	}
+	msg = append(msg, byte(typ>>8), byte(typ), 0, 1, 0, 0, 0, 60, 0, byte(len(rdata)))
+	msg = append(msg, rdata...)
+	an := count(msg, 6) + 1
+	msg[6], msg[7] = byte(an>>8), byte(an)
+	return msg
+}
+
+// answerData returns the last byte of the data of each answer of msg, so the
+// order of the records can be compared.
+func answerData(t *testing.T, msg []byte) []byte {
+	t.Helper()
+	an, _, _, err := sections(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for _, r := range an {
+		data = append(data, msg[r.end-1])
+	}
+	return data
+}
+
+func TestRotateAnswers(t *testing.T) {
+	a := func(b byte) []byte { return []byte{192, 0, 2, b} }
+	cname := []byte{3, 'w', 'w', 'w', 0xc0, dnsHeaderSize}
+	tests := []struct {
+		name    string
+		answers func(msg []byte) []byte
+		n       int
+		want    []byte
+	}{
+		{"single", func(msg []byte) []byte {
+			return appendAnswer(msg, true, typeA, a(1)...)
+		}, 1, []byte{1}},
+		{"rotated by one", func(msg []byte) []byte {
+			msg = appendAnswer(msg, true, typeA, a(1)...)
+			msg = appendAnswer(msg, true, typeA, a(2)...)
+			return appendAnswer(msg, true, typeA, a(3)...)
+		}, 1, []byte{2, 3, 1}},
+		{"rotation wraps", func(msg []byte) []byte {
+			msg = appendAnswer(msg, true, typeA, a(1)...)
+			msg = appendAnswer(msg, true, typeA, a(2)...)
+			return appendAnswer(msg, true, typeA, a(3)...)
+		}, 5, []byte{3, 1, 2}},
+		{"cname kept first", func(msg []byte) []byte {
+			msg = appendAnswer(msg, true, 5 /* CNAME */, cname...)
+			msg = appendAnswer(msg, true, typeA, a(1)...)
+			return appendAnswer(msg, true, typeA, a(2)...)
+		}, 1, []byte{dnsHeaderSize, 2, 1}},
+		{"families rotated apart", func(msg []byte) []byte {
+			msg = appendAnswer(msg, true, typeA, a(1)...)
+			msg = appendAnswer(msg, true, typeA, a(2)...)
+			msg = appendAnswer(msg, true, typeAAAA, append(make([]byte, 15), 3)...)
+			return appendAnswer(msg, true, typeAAAA, append(make([]byte, 15), 4)...)
+		}, 1, []byte{2, 1, 4, 3}},
+		{"uncompressed owner untouched", func(msg []byte) []byte {
+			msg = appendAnswer(msg, false, typeA, a(1)...)
+			return appendAnswer(msg, false, typeA, a(2)...)
+		}, 1, []byte{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.answers(emptyResponse(mkQuery(t, "example.com", typeA, -1), rcodeNoError))
+			if err := rotateAnswers(msg, tt.n); err != nil {
+				t.Fatal(err)
+			}
+			if got := answerData(t, msg); !bytes.Equal(got, tt.want) {
+				t.Errorf("answers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if err := rotateAnswers([]byte{1, 2, 3}, 1); err == nil {
+		t.Error("invalid message accepted")
+	}
+}
+
+// checkSOA checks the authority section of msg holds a single well-formed SOA
+// record matching soa.
+func checkSOA(t *testing.T, msg []byte, soa SOA) {
+	t.Helper()
+	_, ns, _, err := sections(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ns) != 1 || ns[0].typ != typeSOA {
+		t.Fatalf("authority section = %v, want a SOA", ns)
+	}
+	r := ns[0]
+	if ttl := msg[r.ttlOff() : r.ttlOff()+4]; count(ttl, 0)<<16|count(ttl, 2) != int(soa.MinTTL) {
+		t.Errorf("TTL = %x, want %d", ttl, soa.MinTTL)
+	}
+	want, _ := appendName(nil, soa.MName)
+	want, _ = appendName(want, soa.RName)
+	rdata := msg[r.rdOff:r.end]
+	if len(rdata) != len(want)+20 || !bytes.Equal(rdata[:len(want)], want) {
+		t.Fatalf("SOA data = %x, want names %x and 5 counters", rdata, want)
+	}
+	if min := rdata[len(rdata)-4:]; count(min, 0)<<16|count(min, 2) != int(soa.MinTTL) {
+		t.Errorf("minimum = %x, want %d", min, soa.MinTTL)
+	}
+}
+
+func TestNegativeResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		rcode   int
+		soa     SOA
+		wantSOA SOA
+	}{
+		{"defaults", rcodeNXDomain, SOA{}, DefaultSOA},
+		{"configured", rcodeNXDomain, SOA{"ns.example.com.", "admin.example.com.", 300}, SOA{"ns.example.com.", "admin.example.com.", 300}},
+		{"partial", rcodeNoError, SOA{MinTTL: 10}, SOA{DefaultSOA.MName, DefaultSOA.RName, 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := negativeResponse(mkQuery(t, "example.com", typeA, -1), tt.rcode, tt.soa)
+			if rcode(res) != tt.rcode || count(res, 6) != 0 {
+				t.Errorf("rcode = %d, answers = %d, want %d and none", rcode(res), count(res, 6), tt.rcode)
+			}
+			checkSOA(t, res, tt.wantSOA)
+		})
+	}
+	q := []byte{0x12, 0x34, 0x01, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}
+	if res := negativeResponse(q, rcodeNXDomain, SOA{}); count(res, 8) != 0 {
+		t.Error("SOA added with no question")
+	}
+}
+
+func TestCapNegativeTTL(t *testing.T) {
+	positive := func(t *testing.T) []byte {
+		q := mkQuery(t, "example.com", typeA, -1)
+		res := appendAnswer(emptyResponse(q, rcodeNoError), true, typeA, 192, 0, 2, 1)
+		// Same SOA in the authority section as a negative response.
+		soa := negativeResponse(q, rcodeNoError, SOA{MinTTL: 3600})[len(emptyResponse(q, rcodeNoError)):]
+		res = append(res, soa...)
+		res[9] = 1 // NSCOUNT
+		return res
+	}
+	tests := []struct {
+		name    string
+		res     func(t *testing.T) []byte
+		max     uint32
+		wantTTL uint32
+	}{
+		{"nxdomain capped", func(t *testing.T) []byte {
+			return negativeResponse(mkQuery(t, "example.com", typeA, -1), rcodeNXDomain, SOA{MinTTL: 3600})
+		}, 300, 300},
+		{"nodata capped", func(t *testing.T) []byte {
+			return negativeResponse(mkQuery(t, "example.com", typeA, -1), rcodeNoError, SOA{MinTTL: 3600})
+		}, 300, 300},
+		{"below max", func(t *testing.T) []byte {
+			return negativeResponse(mkQuery(t, "example.com", typeA, -1), rcodeNXDomain, SOA{MinTTL: 60})
+		}, 300, 60},
+		{"servfail untouched", func(t *testing.T) []byte {
+			return negativeResponse(mkQuery(t, "example.com", typeA, -1), rcodeServFail, SOA{MinTTL: 3600})
+		}, 300, 3600},
+		{"positive untouched", positive, 300, 3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := tt.res(t)
+			if err := capNegativeTTL(res, tt.max); err != nil {
+				t.Fatal(err)
+			}
+			_, ns, _, err := sections(res)
+			if err != nil || len(ns) != 1 {
+				t.Fatalf("sections: %v, %d authority records", err, len(ns))
+			}
+			r := ns[0]
+			ttl := res[r.ttlOff() : r.ttlOff()+4]
+			min := res[r.end-4 : r.end]
+			if got := uint32(count(ttl, 0)<<16 | count(ttl, 2)); got != tt.wantTTL {
+				t.Errorf("TTL = %d, want %d", got, tt.wantTTL)
+			}
+			if got := uint32(count(min, 0)<<16 | count(min, 2)); got != tt.wantTTL {
+				t.Errorf("minimum = %d, want %d", got, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestBadVersResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		q       []byte
+		wantNil bool
+	}{
+		{"edns1", mkQuery(t, "example.com", typeA, 1), false},
+		{"edns255", mkQuery(t, "example.com", typeAAAA, 255), false},
+		{"short", []byte{1, 2, 3}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := badVersResponse(tt.q)
+			if tt.wantNil {
+				if res != nil {
+					t.Errorf("got %x, want nil", res)
+				}
+				return
+			}
+			// BADVERS (16) is split between the header and the OPT record.
+			if rcode(res) != rcodeBadVers&0xf {
+				t.Errorf("header rcode = %d, want %d", rcode(res), rcodeBadVers&0xf)
+			}
+			if count(res, 10) != 1 {
+				t.Fatalf("ARCOUNT = %d, want 1", count(res, 10))
+			}
+			_, _, ar, err := sections(res)
+			if err != nil || len(ar) != 1 || ar[0].typ != typeOPT {
+				t.Fatalf("additional section = %v, %v, want an OPT record", ar, err)
+			}
+			ttl := res[ar[0].ttlOff():]
+			if ext := int(ttl[0])<<4 | rcode(res); ext != rcodeBadVers {
+				t.Errorf("extended rcode = %d, want %d", ext, rcodeBadVers)
+			}
+			if v, _ := ednsVersion(res); v != ednsVersionSupported {
+				t.Errorf("advertised version = %d, want %d", v, ednsVersionSupported)
+			}
+		})
+	}
+}
+
+func TestSetResponseFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		flags     [2]byte
+		rd        bool
+		wantFlags [2]byte
+	}{
+		{"set ra and rd", [2]byte{0x80, 0x00}, true, [2]byte{0x81, 0x80}},
+		{"clear rd", [2]byte{0x81, 0x00}, false, [2]byte{0x80, 0x80}},
+		{"keep other flags", [2]byte{0x84, 0x83}, true, [2]byte{0x85, 0x83}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := make([]byte, dnsHeaderSize)
+			msg[2], msg[3] = tt.flags[0], tt.flags[1]
+			setResponseFlags(msg, tt.rd)
+			if got := [2]byte{msg[2], msg[3]}; got != tt.wantFlags {
+				t.Errorf("flags = %#x, want %#x", got, tt.wantFlags)
+			}
+		})
+	}
+	// Too short messages are left as is.
+	setResponseFlags(make([]byte, 3), true)
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+)
+
+// loadEndpoint returns the endpoint persisted in EndpointFile, or nil if none
+// is available.
+func (p *Proxy) loadEndpoint() *endpoint.Endpoint {
+	if p.EndpointFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(p.EndpointFile)
+	if err != nil {
+		return nil
+	}
+	e, err := endpoint.New(strings.TrimSpace(string(b)))
+	if err != nil {
+		p.logErr(fmt.Errorf("load endpoint: %v", err))
+		return nil
+	}
+	return e
+}
+
+// saveEndpoint persists e in EndpointFile so it is tried first on next start.
+func (p *Proxy) saveEndpoint(e string) {
+	if p.EndpointFile == "" {
+		return
+	}
+	if err := ioutil.WriteFile(p.EndpointFile, []byte(e), 0644); err != nil {
+		p.logErr(fmt.Errorf("save endpoint: %v", err))
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEndpointState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "endpointstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		file    string
+		save    string
+		content string // written as is if save is empty
+		want    string
+	}{
+		{"no file set", "", "https://dns1.nextdns.io#45.90.28.0", "", ""},
+		{"round trip", "a.txt", "https://dns1.nextdns.io#45.90.28.0", "", "https://dns1.nextdns.io#45.90.28.0"},
+		{"trailing newline", "b.txt", "", "https://dns2.nextdns.io\n", "https://dns2.nextdns.io"},
+		{"missing", "missing.txt", "", "", ""},
+		{"invalid", "c.txt", "", "not an endpoint", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{}
+			if tt.file != "" {
+				p.EndpointFile = filepath.Join(dir, tt.file)
+			}
+			if tt.save != "" {
+				p.saveEndpoint(tt.save)
+			} else if tt.content != "" {
+				if err := ioutil.WriteFile(p.EndpointFile, []byte(tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			e := p.loadEndpoint()
+			got := ""
+			if e != nil {
+				got = e.String()
+			}
+			if got != tt.want {
+				t.Errorf("loaded %q, want %q", got, tt.want)
+			}
+			if e == nil {
+				return
+			}
+			// The loaded endpoint is tried first, and only once.
+			op := &onceProvider{e: e}
+			first, _ := op.GetEndpoints(context.Background())
+			next, _ := op.GetEndpoints(context.Background())
+			if len(first) != 1 || first[0] != e || len(next) != 0 {
+				t.Errorf("onceProvider returned %v then %v", first, next)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// localResolverTimeout is the maximum time spent waiting for the local
+// resolver.
+const localResolverTimeout = 2 * time.Second
+
+// Range of the random source ports used to query the local resolver.
+const (
+	minSourcePort = 1024
+	maxSourcePort = 65535
+)
+
+// matchDomain returns true if qname is one of domains or a sub-domain of one
+// of them. Comparison is case insensitive.
+func matchDomain(qname string, domains []string) bool {
+	qname = strings.ToLower(strings.TrimSuffix(qname, "."))
+	for _, d := range domains {
+		d = strings.ToLower(strings.Trim(d, "."))
+		if d == "" {
+			continue
+		}
+		if qname == d || strings.HasSuffix(qname, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardDNS53 sends the DNS message q to the plain DNS server at addr over
+// UDP and writes the response to buf, returning its size. As the exchange is
+// not encrypted, it is hardened against off-path spoofing: the query is sent
+// from a random source port over a connected socket, so the system drops
+// datagrams from another address or port, and responses which ID or question
+// do not match q are ignored. The exchange is aborted once ctx is done.
+func forwardDNS53(ctx context.Context, addr string, q, buf []byte) (int, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	ctx, cancel := context.WithTimeout(ctx, localResolverTimeout)
+	defer cancel()
+	c, err := dialRandomPort(ctx, addr)
+	if err != nil {
+		return -1, err
+	}
+	defer c.Close()
+	if t, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(t)
+	}
+	// Unblock the exchange as soon as ctx is canceled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	if _, err = c.Write(q); err != nil {
+		return -1, err
+	}
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return -1, fmt.Errorf("local resolver %s: %v", addr, err)
+		}
+		if matchResponse(q, buf[:n]) {
+			return n, nil
+		}
+		// Spoofed or stale response, keep waiting for the right one.
+	}
+}
+
+// dialRandomPort connects a UDP socket to addr from a random source port
+// instead of relying on the ephemeral port allocation of the system.
+func dialRandomPort(ctx context.Context, addr string) (net.Conn, error) {
+	var err error
+	for i := 0; i < 5; i++ {
+		var b [2]byte
+		if _, err = rand.Read(b[:]); err != nil {
+			break
+		}
+		port := minSourcePort + int(binary.BigEndian.Uint16(b[:]))%(maxSourcePort-minSourcePort+1)
+		d := &net.Dialer{LocalAddr: &net.UDPAddr{Port: port}}
+		var c net.Conn
+		if c, err = d.DialContext(ctx, "udp", addr); err == nil {
+			return c, nil
+		}
+		// The port may be in use, try another one.
+	}
+	// Fallback on the ports allocated by the system.
+	d := &net.Dialer{}
+	return d.DialContext(ctx, "udp", addr)
+}
+
+// matchResponse returns true if res is a response to q with the same ID and
+// question.
+func matchResponse(q, res []byte) bool {
+	if len(q) < dnsHeaderSize || len(res) < dnsHeaderSize {
+		return false
+	}
+	if q[0] != res[0] || q[1] != res[1] || res[2]&0x80 == 0 {
+		return false // ID, QR
+	}
+	qEnd, err := questionEnd(q)
+	if err != nil {
+		return false
+	}
+	resEnd, err := questionEnd(res)
+	if err != nil || resEnd != qEnd {
+		return false
+	}
+	// Names are compared case insensitively as servers may not preserve it.
+	for i := dnsHeaderSize; i < qEnd; i++ {
+		a, b := q[i], res[i]
+		if i < qEnd-4 { // name, then exact type and class
+			a, b = lowerASCII(a), lowerASCII(b)
+		}
+		if a != b {
+			return false
+		}
+	}
+	return true
+}
+
+func lowerASCII(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMatchResponse(t *testing.T) {
+	q := mkQuery(t, "www.example.com", typeA, -1)
+	tests := []struct {
+		name string
+		res  func() []byte
+		want bool
+	}{
+		{"match", func() []byte { return answerA(q, "192.0.2.1") }, true},
+		{"name case", func() []byte {
+			return answerA(mkQuery(t, "WWW.Example.com", typeA, -1), "192.0.2.1")
+		}, true},
+		{"other id", func() []byte {
+			res := answerA(q, "192.0.2.1")
+			res[1]++
+			return res
+		}, false},
+		{"query", func() []byte { return append([]byte(nil), q...) }, false},
+		{"other name", func() []byte {
+			return answerA(mkQuery(t, "www.example.net", typeA, -1), "192.0.2.1")
+		}, false},
+		{"other type", func() []byte {
+			return emptyResponse(mkQuery(t, "www.example.com", typeAAAA, -1), rcodeNoError)
+		}, false},
+		{"truncated", func() []byte { return answerA(q, "192.0.2.1")[:dnsHeaderSize-1] }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchResponse(q, tt.res()); got != tt.want {
+				t.Errorf("matchResponse = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	tests := []struct {
+		qname   string
+		domains []string
+		want    bool
+	}{
+		{"nas.lan.", []string{"lan"}, true},
+		{"lan.", []string{".lan."}, true},
+		{"NAS.Corp.Example.com.", []string{"corp.example.com"}, true},
+		{"evillan.", []string{"lan"}, false},
+		{"nas.lan.", []string{""}, false},
+		{"nas.lan.", nil, false},
+	}
+	for _, tt := range tests {
+		if got := matchDomain(tt.qname, tt.domains); got != tt.want {
+			t.Errorf("matchDomain(%q, %v) = %v, want %v", tt.qname, tt.domains, got, tt.want)
+		}
+	}
+}
+
+func TestForwardDNS53(t *testing.T) {
+	q := mkQuery(t, "nas.lan", typeA, -1)
+	plain, stopPlain := udpServer(t, func(q []byte) []byte {
+		return answerA(q, "192.0.2.10")
+	})
+	defer stopPlain()
+	// The spoofed response sent first must be ignored.
+	spoofer, stopSpoofer := udpSpoofer(t, func(q []byte) [][]byte {
+		spoofed := answerA(q, "203.0.113.66")
+		spoofed[0]++
+		return [][]byte{spoofed, answerA(q, "192.0.2.10")}
+	})
+	defer stopSpoofer()
+	servers := []struct {
+		name string
+		addr string
+	}{
+		{"plain", plain},
+		{"spoofed", spoofer},
+	}
+	for _, srv := range servers {
+		t.Run(srv.name, func(t *testing.T) {
+			buf := make([]byte, 1500)
+			n, err := forwardDNS53(context.Background(), srv.addr, q, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := answerData(t, buf[:n]); len(got) != 1 || got[0] != 10 {
+				t.Errorf("answers %v, want 192.0.2.10", got)
+			}
+		})
+	}
+}
+
+func TestForwardDNS53Canceled(t *testing.T) {
+	silent, stop := udpSpoofer(t, func(q []byte) [][]byte { return nil })
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := forwardDNS53(ctx, silent, mkQuery(t, "nas.lan", typeA, -1), make([]byte, 1500)); err == nil {
+		t.Fatal("forwardDNS53 succeeded without a response")
+	}
+	if d := time.Since(start); d >= localResolverTimeout {
+		t.Errorf("returned after %v, not on cancel", d)
+	}
+}
+
+// udpSpoofer returns the address of a UDP server answering each packet with
+// all the ones returned by answer, and a function stopping it.
+func udpSpoofer(t *testing.T, answer func(q []byte) [][]byte) (string, func()) {
+	t.Helper()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			for _, res := range answer(append([]byte(nil), buf[:n]...)) {
+				_, _ = c.WriteTo(res, addr)
+			}
+		}
+	}()
+	return c.LocalAddr().String(), func() { c.Close() }
+}
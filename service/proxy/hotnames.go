@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// hotNamesWindow is the duration of a counting window. The most queried
+	// names are computed over the current and previous windows.
+	hotNamesWindow = 24 * time.Hour
+
+	// maxHotNamesTracked bounds the number of distinct names counted per
+	// window. Names first seen once the limit is reached are not counted.
+	maxHotNamesTracked = 10000
+
+	// MaxHotNames is the maximum number of names returned by HotNames.
+	MaxHotNames = 1000
+)
+
+// privateSuffixes lists suffixes of names considered to disclose information
+// about the local network.
+var privateSuffixes = []string{
+	".local.", ".lan.", ".home.", ".internal.", ".corp.", ".home.arpa.",
+	".in-addr.arpa.", ".ip6.arpa.",
+}
+
+// hotNames counts queried names over a sliding window.
+type hotNames struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	current     map[string]uint64
+	previous    map[string]uint64
+}
+
+func (h *hotNames) add(qname string) {
+	qname = strings.ToLower(qname)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rotateLocked()
+	if _, found := h.current[qname]; !found && len(h.current) >= maxHotNamesTracked {
+		return
+	}
+	h.current[qname]++
+}
+
+func (h *hotNames) rotateLocked() {
+	if h.current == nil {
+		h.current = map[string]uint64{}
+		h.windowStart = time.Now()
+	}
+	if since := time.Since(h.windowStart); since > hotNamesWindow {
+		h.previous = h.current
+		if since > 2*hotNamesWindow {
+			// The previous window is outdated too.
+			h.previous = nil
+		}
+		h.current = map[string]uint64{}
+		h.windowStart = time.Now()
+	}
+}
+
+// counts returns the counts of the names over the current and previous
+// windows.
+func (h *hotNames) counts() map[string]uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := map[string]uint64{}
+	for n, c := range h.previous {
+		counts[n] += c
+	}
+	for n, c := range h.current {
+		counts[n] += c
+	}
+	return counts
+}
+
+// top returns the limit most queried names. When excludePrivate is true,
+// single label names, reverse lookups and names under private suffixes or
+// excluded domains are omitted.
+func (h *hotNames) top(limit int, excludePrivate bool, excluded []string) []string {
+	counts := h.counts()
+	names := make([]string, 0, len(counts))
+	for n := range counts {
+		if excludePrivate && isPrivateName(n, excluded) {
+			continue
+		}
+		names = append(names, n)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if limit <= 0 || limit > MaxHotNames {
+		limit = MaxHotNames
+	}
+	if len(names) > limit {
+		names = names[:limit]
+	}
+	return names
+}
+
+func isPrivateName(qname string, excluded []string) bool {
+	if strings.Count(qname, ".") <= 1 {
+		return true // single label
+	}
+	for _, s := range privateSuffixes {
+		if strings.HasSuffix(qname, s) {
+			return true
+		}
+	}
+	return matchDomain(qname, excluded)
+}
+
+// HotNames returns up to limit names among the most queried over the last day,
+// for instance to pre-resolve them on other machines of a fleet. Names
+// revealing the local network are omitted when excludePrivate is true. Names
+// are only counted when the TrackHotNames option is set.
+func (p *Proxy) HotNames(limit int, excludePrivate bool) []string {
+	return p.hotNames.top(limit, excludePrivate, p.options().LocalDomains)
+}
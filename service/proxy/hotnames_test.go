@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIsPrivateName(t *testing.T) {
+	tests := []struct {
+		qname    string
+		excluded []string
+		want     bool
+	}{
+		{"router.", nil, true},
+		{"nas.lan.", nil, true},
+		{"printer.home.arpa.", nil, true},
+		{"1.0.168.192.in-addr.arpa.", nil, true},
+		{"www.example.com.", nil, false},
+		{"lan.example.com.", nil, false},
+		{"intranet.example.com.", []string{"example.com"}, true},
+		{"www.example.net.", []string{"example.com"}, false},
+	}
+	for _, tt := range tests {
+		if got := isPrivateName(tt.qname, tt.excluded); got != tt.want {
+			t.Errorf("isPrivateName(%q, %v) = %v, want %v", tt.qname, tt.excluded, got, tt.want)
+		}
+	}
+}
+
+func TestHotNamesTop(t *testing.T) {
+	var h hotNames
+	for name, n := range map[string]int{
+		"www.example.com.":  5,
+		"WWW.Example.com.":  1, // counted with www.example.com.
+		"api.example.com.":  3,
+		"cdn.example.net.":  3,
+		"nas.lan.":          10,
+		"app.corp.example.": 4,
+		"rare.example.org.": 1,
+	} {
+		for i := 0; i < n; i++ {
+			h.add(name)
+		}
+	}
+	tests := []struct {
+		name           string
+		limit          int
+		excludePrivate bool
+		excluded       []string
+		want           []string
+	}{
+		{"all", 0, false, nil, []string{"nas.lan.", "www.example.com.", "app.corp.example.", "api.example.com.", "cdn.example.net.", "rare.example.org."}},
+		{"limit", 3, false, nil, []string{"nas.lan.", "www.example.com.", "app.corp.example."}},
+		{"private excluded", 3, true, nil, []string{"www.example.com.", "app.corp.example.", "api.example.com."}},
+		{"domains excluded", 0, true, []string{"example.com"}, []string{"app.corp.example.", "cdn.example.net.", "rare.example.org."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.top(tt.limit, tt.excludePrivate, tt.excluded); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("top = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHotNamesMaxLimit(t *testing.T) {
+	var h hotNames
+	for i := 0; i < MaxHotNames+10; i++ {
+		h.add(fmt.Sprintf("host%d.example.com.", i))
+	}
+	for _, limit := range []int{0, -1, MaxHotNames + 1} {
+		if got := len(h.top(limit, false, nil)); got != MaxHotNames {
+			t.Errorf("top(%d) returned %d names, want %d", limit, got, MaxHotNames)
+		}
+	}
+}
+
+func TestHotNamesRotation(t *testing.T) {
+	tests := []struct {
+		name string
+		age  time.Duration // of the window the names were counted in
+		want map[string]uint64
+	}{
+		{"current window", time.Hour, map[string]uint64{"old.example.com.": 2, "new.example.com.": 1}},
+		{"previous window", hotNamesWindow + time.Hour, map[string]uint64{"old.example.com.": 2, "new.example.com.": 1}},
+		{"outdated", 2*hotNamesWindow + time.Hour, map[string]uint64{"new.example.com.": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h hotNames
+			h.add("old.example.com.")
+			h.add("old.example.com.")
+			h.windowStart = h.windowStart.Add(-tt.age)
+			h.add("new.example.com.")
+			if got := h.counts(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("counts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// Names of the previous window are dropped on the next rotation.
+	var h hotNames
+	h.add("old.example.com.")
+	h.windowStart = h.windowStart.Add(-hotNamesWindow - time.Hour)
+	h.add("new.example.com.")
+	h.windowStart = h.windowStart.Add(-hotNamesWindow - time.Hour)
+	h.add("new.example.com.")
+	if got, want := h.counts(), map[string]uint64{"new.example.com.": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("counts after two rotations = %v, want %v", got, want)
+	}
+}
+
+func TestProxyHotNames(t *testing.T) {
+	p := &Proxy{}
+	if err := p.SetOptions(Options{LocalDomains: []string{"example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"www.example.com.", "www.example.net.", "www.example.net."} {
+		p.hotNames.add(name)
+	}
+	if got, want := p.HotNames(10, true), []string{"www.example.net."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("HotNames(excludePrivate) = %v, want %v", got, want)
+	}
+	if got, want := p.HotNames(10, false), []string{"www.example.net.", "www.example.com."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("HotNames = %v, want %v", got, want)
+	}
+}
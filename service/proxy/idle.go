@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultIdleTimeout defines the default value for Options IdleTimeout.
+const DefaultIdleTimeout = 5 * time.Minute
+
+// touch records query activity, preventing the idle teardown.
+func (p *Proxy) touch() {
+	p.idleMu.Lock()
+	defer p.idleMu.Unlock()
+	p.lastQuery = time.Now()
+	p.idle = false
+}
+
+func (p *Proxy) idleTimeout() time.Duration {
+	timeout := p.options().IdleTimeout
+	if timeout == 0 {
+		timeout = DefaultIdleTimeout
+	}
+	return timeout
+}
+
+// watchIdle resets the upstream connections when no query was received for
+// IdleTimeout, until ctx is done. The selected endpoint is kept and new
+// connections are established on the next query. The timeout is read again
+// at each check so changes apply while running.
+func (p *Proxy) watchIdle(ctx context.Context) {
+	for {
+		interval := p.idleTimeout() / 4
+		if interval <= 0 {
+			// Disabled, check again later in case it gets enabled.
+			interval = DefaultIdleTimeout / 4
+		}
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		timeout := p.idleTimeout()
+		if timeout < 0 {
+			continue
+		}
+		p.idleMu.Lock()
+		teardown := !p.idle && time.Since(p.lastQuery) > timeout
+		if teardown {
+			p.idle = true
+		}
+		p.idleMu.Unlock()
+		if teardown {
+			n := p.pool.reset()
+			p.logInfo(fmt.Sprintf("No query received recently, closed %d upstream connections", n))
+		}
+	}
+}
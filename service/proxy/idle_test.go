@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIdleTeardown(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeout      time.Duration
+		wantTeardown bool
+	}{
+		{"teardown", 40 * time.Millisecond, true},
+		{"disabled", -1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, accepted := testServer(t)
+			srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				res, err := upstreamFunc(func(q []byte) []byte {
+					return answerA(q, "192.0.2.1")
+				}).RoundTrip(r)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				b, _ := ioutil.ReadAll(res.Body)
+				_, _ = w.Write(b)
+			})
+			defer srv.Close()
+			roots := x509.NewCertPool()
+			roots.AddCert(srv.Certificate())
+			p := &Proxy{Upstream: "https://example.com/abcdef"}
+			p.pool.rootCAs = roots
+			p.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				return p.pool.roundTrip("example.com", srv.Listener.Addr().String(), "", req)
+			})
+			if err := p.SetOptions(Options{IdleTimeout: tt.timeout}); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.watchIdle(ctx)
+
+			q := mkQuery(t, "example.com", typeA, -1)
+			if res := handle(t, p, q); count(res, 6) != 1 {
+				t.Fatalf("answers = %d, want 1", count(res, 6))
+			}
+			time.Sleep(200 * time.Millisecond)
+			wantConns := 1
+			if tt.wantTeardown {
+				wantConns = 0
+			}
+			if n := p.pool.openConns(); n != wantConns {
+				t.Errorf("%d open connections after idle, want %d", n, wantConns)
+			}
+			if res := handle(t, p, q); count(res, 6) != 1 {
+				t.Fatalf("answers after idle = %d, want 1", count(res, 6))
+			}
+			wantAccepted := 1
+			if tt.wantTeardown {
+				wantAccepted = 2
+			}
+			if n := accepted(); n != wantAccepted {
+				t.Errorf("server accepted %d connections, want %d", n, wantAccepted)
+			}
+		})
+	}
+}
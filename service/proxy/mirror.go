@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxMirrorInflight is the maximum number of concurrent mirrored queries.
+	// Queries are not mirrored while this limit is reached.
+	maxMirrorInflight = 16
+
+	// mirrorTimeout is the maximum time spent sending a mirrored query.
+	mirrorTimeout = 5 * time.Second
+)
+
+// mirrorer sends a copy of queries to a secondary DoH upstream, discarding the
+// responses.
+type mirrorer struct {
+	client   *http.Client
+	inflight chan struct{}
+}
+
+func newMirrorer() *mirrorer {
+	return &mirrorer{
+		client:   &http.Client{Timeout: mirrorTimeout},
+		inflight: make(chan struct{}, maxMirrorInflight),
+	}
+}
+
+// mirror sends a copy of the DNS message q to upstream in the background. It
+// never blocks and silently drops the query if too many are in flight.
+func (m *mirrorer) mirror(upstream string, q []byte, errorLog func(error)) {
+	select {
+	case m.inflight <- struct{}{}:
+	default:
+		return
+	}
+	q = append([]byte(nil), q...) // q is reused for the response
+	go func() {
+		defer func() { <-m.inflight }()
+		req, err := http.NewRequest("POST", upstream, bytes.NewReader(q))
+		if err != nil {
+			errorLog(fmt.Errorf("mirror: %v", err))
+			return
+		}
+		req.Header.Set("Content-Type", "application/dns-message")
+		res, err := m.client.Do(req)
+		if err != nil {
+			errorLog(fmt.Errorf("mirror: %v", err))
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+)
+
+const (
+	// DefaultRouterRefreshInterval defines the default value for Options
+	// RouterRefreshInterval.
+	DefaultRouterRefreshInterval = 6 * time.Hour
+
+	// DefaultPreferredRetryInterval defines the default value for Options
+	// PreferredRetryInterval.
+	DefaultPreferredRetryInterval = 30 * time.Second
+
+	// DefaultPreferredRetryMaxInterval defines the default value for Options
+	// PreferredRetryMaxInterval.
+	DefaultPreferredRetryMaxInterval = 30 * time.Minute
+)
+
+// routerProvider wraps a endpoint.SourceURLProvider to keep the last good list
+// of endpoints returned by the router and refresh it in the background.
+type routerProvider struct {
+	source endpoint.Provider
+
+	// onChange is called whenever a refresh returns a list different from the
+	// previous good one.
+	onChange func(endpoints []*endpoint.Endpoint)
+
+	mu        sync.Mutex
+	endpoints []*endpoint.Endpoint
+}
+
+// GetEndpoints implements the endpoint.Provider interface. The last good list
+// is returned if any, otherwise the router is queried.
+func (p *routerProvider) GetEndpoints(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	p.mu.Lock()
+	endpoints := p.endpoints
+	p.mu.Unlock()
+	if endpoints != nil {
+		return endpoints, nil
+	}
+	return p.refresh(ctx)
+}
+
+// refresh fetches the list of endpoints from the router. On error, the last
+// good list is kept.
+func (p *routerProvider) refresh(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	endpoints, err := p.source.GetEndpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	changed := p.endpoints != nil && !endpointsEqual(p.endpoints, endpoints)
+	p.endpoints = endpoints
+	p.mu.Unlock()
+	if changed && p.onChange != nil {
+		p.onChange(endpoints)
+	}
+	return endpoints, nil
+}
+
+// run refreshes the list of endpoints every interval until ctx is done. The
+// interval is read again after each refresh so changes apply to the next one.
+func (p *routerProvider) run(ctx context.Context, interval func() time.Duration, errorLog func(error)) {
+	for {
+		t := time.NewTimer(interval())
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+			if _, err := p.refresh(ctx); err != nil && ctx.Err() == nil {
+				errorLog(err)
+			}
+		}
+	}
+}
+
+// contains returns true if e is part of the last good list of endpoints.
+func (p *routerProvider) contains(e *endpoint.Endpoint) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e2 := range p.endpoints {
+		// The path and bootstrap IP are ignored as they may be changed by
+		// upstreamProvider.
+		if e.Hostname == e2.Hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// retryPreferred refreshes the endpoints of router and re-runs the endpoint
+// discovery on a new transport with an exponential backoff until it selects an
+// endpoint from router, replacing the current transport, or ctx is done. It is
+// used when the discovery fell back on another provider, typically on cold
+// start when the network is not ready yet.
+func (p *Proxy) retryPreferred(ctx context.Context, router *routerProvider) {
+	opts := p.options()
+	backoff := opts.PreferredRetryInterval
+	if backoff <= 0 {
+		backoff = DefaultPreferredRetryInterval
+	}
+	maxBackoff := opts.PreferredRetryMaxInterval
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultPreferredRetryMaxInterval
+	}
+	for {
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		var preferred *endpoint.Endpoint
+		if _, err := router.refresh(ctx); err == nil {
+			err = p.swapTransport(ctx, nil, func(e *endpoint.Endpoint) bool {
+				if router.contains(e) {
+					preferred = e
+					return true
+				}
+				return false
+			})
+			if err != nil && err != errEndpointRejected {
+				return
+			}
+		}
+		if preferred != nil {
+			p.logInfo(fmt.Sprintf("Preferred endpoint available: %s", preferred.Hostname))
+			if p.OnPreferredEndpoint != nil {
+				p.OnPreferredEndpoint(preferred.String())
+			}
+			return
+		}
+		if backoff < maxBackoff {
+			backoff <<= 1
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+// onceProvider provides an endpoint on its first call only so it is tried
+// first, the following discoveries relying on the other providers.
+type onceProvider struct {
+	mu sync.Mutex
+	e  *endpoint.Endpoint
+}
+
+// GetEndpoints implements the endpoint.Provider interface.
+func (p *onceProvider) GetEndpoints(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.e
+	p.e = nil
+	if e == nil {
+		return nil, nil
+	}
+	return []*endpoint.Endpoint{e}, nil
+}
+
+// upstreamProvider wraps a provider to adapt its endpoints to the proxy. Their
+// path is cleared so requests keep the path of Proxy Upstream holding the
+// configuration ID whatever endpoint they are sent to, instead of silently
+// falling back on a profile with no filtering. Those which hostname is defined
+// in Options StaticHosts are contacted using the first IP defined for them,
+// instead of their bootstrap IP or a DNS lookup. DoH endpoints are shared by
+// all the transports of the proxy, see sharedEndpoint.
+type upstreamProvider struct {
+	proxy    *Proxy
+	provider endpoint.Provider
+}
+
+// GetEndpoints implements the endpoint.Provider interface.
+func (up *upstreamProvider) GetEndpoints(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	// The endpoint.Manager only stops the discovery when ctx errors are
+	// returned as is, which the providers querying a server do not do.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	endpoints, err := up.provider.GetEndpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*endpoint.Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		if e.Protocol != endpoint.ProtocolDOH {
+			res = append(res, e)
+			continue
+		}
+		bootstrap := e.Bootstrap
+		if ips := up.proxy.staticHost(e.Hostname); len(ips) > 0 {
+			bootstrap = ips[0]
+		}
+		u := "https://" + e.Hostname
+		if bootstrap != "" {
+			u += "#" + bootstrap
+		}
+		ae, created, err := up.proxy.sharedEndpoint(u)
+		if err != nil {
+			return nil, err
+		}
+		if created && e.Path != "" {
+			up.proxy.logInfo(fmt.Sprintf("Ignoring path %s of endpoint %s to keep the configuration", e.Path, e.Hostname))
+		}
+		res = append(res, ae)
+	}
+	return res, nil
+}
+
+// sharedEndpoint returns the endpoint for u, reusing the one returned
+// previously if any so the connections used by the endpoint package to test
+// it are not multiplied by transport replacements. created is true if the
+// endpoint was not returned before.
+func (p *Proxy) sharedEndpoint(u string) (e *endpoint.Endpoint, created bool, err error) {
+	p.endpointsMu.Lock()
+	defer p.endpointsMu.Unlock()
+	if e = p.endpoints[u]; e != nil {
+		return e, false, nil
+	}
+	if e, err = endpoint.New(u); err != nil {
+		return nil, false, err
+	}
+	if p.endpoints == nil {
+		p.endpoints = map[string]*endpoint.Endpoint{}
+	}
+	p.endpoints[u] = e
+	return e, true, nil
+}
+
+func endpointsEqual(a, b []*endpoint.Endpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+)
+
+// mockRouter serves a list of endpoints like the NextDNS router API.
+type mockRouter struct {
+	mu       sync.Mutex
+	list     string
+	fail     bool
+	requests int
+}
+
+func (r *mockRouter) set(list string, fail bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.list, r.fail = list, fail
+}
+
+func (r *mockRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if r.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte(r.list))
+}
+
+func (r *mockRouter) requestCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests
+}
+
+func hostnames(endpoints []*endpoint.Endpoint) []string {
+	names := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		names = append(names, e.Hostname)
+	}
+	return names
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRouterProvider(t *testing.T) {
+	router := &mockRouter{}
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	var changes [][]string
+	p := &routerProvider{
+		source: &endpoint.SourceURLProvider{SourceURL: srv.URL, Client: srv.Client()},
+		onChange: func(endpoints []*endpoint.Endpoint) {
+			changes = append(changes, hostnames(endpoints))
+		},
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		list        string
+		fail        bool
+		wantErr     bool
+		wantList    []string
+		wantChanges int
+	}{
+		{"initial", `[{"hostname":"a.example.com","ip":"192.0.2.1"}]`, false, false, []string{"a.example.com"}, 0},
+		{"unchanged", `[{"hostname":"a.example.com","ip":"192.0.2.1"}]`, false, false, []string{"a.example.com"}, 0},
+		{"updated", `[{"hostname":"b.example.com"},{"hostname":"a.example.com","ip":"192.0.2.1"}]`, false, false, []string{"b.example.com", "a.example.com"}, 1},
+		{"router error keeps last good", ``, true, true, []string{"b.example.com", "a.example.com"}, 1},
+		{"invalid list keeps last good", `not json`, false, true, []string{"b.example.com", "a.example.com"}, 1},
+		{"decommissioned", `[{"hostname":"b.example.com"}]`, false, false, []string{"b.example.com"}, 2},
+	}
+	for _, tt := range tests {
+		router.set(tt.list, tt.fail)
+		_, err := p.refresh(ctx)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: refresh err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		requests := router.requestCount()
+		endpoints, err := p.GetEndpoints(ctx)
+		if err != nil {
+			t.Fatalf("%s: GetEndpoints: %v", tt.name, err)
+		}
+		if got := hostnames(endpoints); !equalStrings(got, tt.wantList) {
+			t.Errorf("%s: endpoints = %v, want %v", tt.name, got, tt.wantList)
+		}
+		if router.requestCount() != requests {
+			t.Errorf("%s: GetEndpoints queried the router instead of using the last good list", tt.name)
+		}
+		if len(changes) != tt.wantChanges {
+			t.Errorf("%s: %d changes reported, want %d", tt.name, len(changes), tt.wantChanges)
+		}
+	}
+	if len(changes) == 2 && !equalStrings(changes[1], []string{"b.example.com"}) {
+		t.Errorf("last change = %v", changes[1])
+	}
+}
+
+func TestRouterProviderRun(t *testing.T) {
+	router := &mockRouter{list: `[{"hostname":"a.example.com"}]`}
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	changed := make(chan []string, 1)
+	p := &routerProvider{
+		source: &endpoint.SourceURLProvider{SourceURL: srv.URL, Client: srv.Client()},
+		onChange: func(endpoints []*endpoint.Endpoint) {
+			select {
+			case changed <- hostnames(endpoints):
+			default:
+			}
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := p.GetEndpoints(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go p.run(ctx, func() time.Duration { return 10 * time.Millisecond }, func(err error) {
+		t.Errorf("refresh: %v", err)
+	})
+	router.set(`[{"hostname":"b.example.com"}]`, false)
+	select {
+	case names := <-changed:
+		if !equalStrings(names, []string{"b.example.com"}) {
+			t.Errorf("refreshed endpoints = %v", names)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("list not refreshed in the background")
+	}
+}
+
+func TestRouterRefreshInterval(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		want     time.Duration
+	}{
+		{0, DefaultRouterRefreshInterval},
+		{-time.Second, DefaultRouterRefreshInterval},
+		{time.Hour, time.Hour},
+	}
+	for _, tt := range tests {
+		p := &Proxy{}
+		_ = p.SetOptions(Options{RouterRefreshInterval: tt.interval})
+		if got := p.routerRefreshInterval(); got != tt.want {
+			t.Errorf("routerRefreshInterval(%v) = %v, want %v", tt.interval, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPreferred(t *testing.T) {
+	tests := []struct {
+		name          string
+		upAfter       time.Duration // negative for never
+		wantPreferred bool
+	}{
+		{"cold start then recover", 50 * time.Millisecond, true},
+		{"router down", -1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fallbackAddr, stopFallback := udpEcho(t)
+			defer stopFallback()
+			routerAddr, stopRouter := udpEcho(t)
+			defer stopRouter()
+			var mu sync.Mutex
+			up := false
+			router := &routerProvider{
+				source: providerFunc(func(ctx context.Context) ([]*endpoint.Endpoint, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					if !up {
+						return nil, errors.New("network unreachable")
+					}
+					return []*endpoint.Endpoint{{Protocol: endpoint.ProtocolDNS, Hostname: routerAddr}}, nil
+				}),
+			}
+			preferred := make(chan string, 1)
+			p := &Proxy{OnPreferredEndpoint: func(e string) { preferred <- e }}
+			if err := p.SetOptions(Options{
+				PreferredRetryInterval:    10 * time.Millisecond,
+				PreferredRetryMaxInterval: 40 * time.Millisecond,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			p.testManager = func(ctx context.Context, first *endpoint.Endpoint) *endpoint.Manager {
+				return &endpoint.Manager{
+					Providers: []endpoint.Provider{
+						router,
+						endpoint.StaticProvider([]*endpoint.Endpoint{{Protocol: endpoint.ProtocolDNS, Hostname: fallbackAddr}}),
+					},
+				}
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			m, tctx := p.replaceTransport(ctx, nil)
+			if err := m.Test(ctx); err != nil {
+				t.Fatal(err)
+			}
+			initial := p.transport()
+
+			go p.retryPreferred(tctx, router)
+			if tt.upAfter >= 0 {
+				time.AfterFunc(tt.upAfter, func() {
+					mu.Lock()
+					up = true
+					mu.Unlock()
+				})
+			}
+			select {
+			case e := <-preferred:
+				if !tt.wantPreferred {
+					t.Fatalf("preferred endpoint %s reported", e)
+				}
+				if e != routerAddr {
+					t.Errorf("preferred endpoint = %s, want %s", e, routerAddr)
+				}
+				if p.transport() == initial {
+					t.Error("transport not replaced")
+				}
+			case <-time.After(time.Second):
+				if tt.wantPreferred {
+					t.Fatal("preferred endpoint not reported")
+				}
+				if p.transport() != initial {
+					t.Error("transport replaced without a preferred endpoint")
+				}
+			}
+			// The current transport is not tested meanwhile, so it still
+			// uses the fallback endpoint.
+			var active string
+			_ = m.Do(ctx, func(e *endpoint.Endpoint) error {
+				active = e.Hostname
+				return nil
+			})
+			if active != fallbackAddr {
+				t.Errorf("initial transport endpoint = %s, want %s", active, fallbackAddr)
+			}
+		})
+	}
+}
+
+func TestUpstreamProvider(t *testing.T) {
+	var path string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+	}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	tests := []struct {
+		name          string
+		e             *endpoint.Endpoint
+		staticHosts   map[string][]string
+		wantBootstrap string
+	}{
+		{"path cleared", &endpoint.Endpoint{Protocol: endpoint.ProtocolDOH, Hostname: "anycast.dns.nextdns.io", Path: "/dns-query"}, nil, ""},
+		{"bootstrap kept", &endpoint.Endpoint{Protocol: endpoint.ProtocolDOH, Hostname: "dns1.nextdns.io", Bootstrap: "192.0.2.1"}, nil, "192.0.2.1"},
+		{"static host", &endpoint.Endpoint{Protocol: endpoint.ProtocolDOH, Hostname: "dns2.nextdns.io", Bootstrap: "192.0.2.1"},
+			map[string][]string{"dns2.nextdns.io": {"192.0.2.10", "192.0.2.11"}}, "192.0.2.10"},
+		{"dns unchanged", &endpoint.Endpoint{Protocol: endpoint.ProtocolDNS, Hostname: "192.0.2.53:53"}, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{}
+			if err := p.SetOptions(Options{StaticHosts: tt.staticHosts}); err != nil {
+				t.Fatal(err)
+			}
+			up := &upstreamProvider{proxy: p, provider: endpoint.StaticProvider([]*endpoint.Endpoint{tt.e})}
+			endpoints, err := up.GetEndpoints(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(endpoints) != 1 {
+				t.Fatalf("%d endpoints, want 1", len(endpoints))
+			}
+			e := endpoints[0]
+			if e.Hostname != tt.e.Hostname || e.Bootstrap != tt.wantBootstrap {
+				t.Errorf("endpoint %s#%s, want %s#%s", e.Hostname, e.Bootstrap, tt.e.Hostname, tt.wantBootstrap)
+			}
+			if e.Protocol != endpoint.ProtocolDOH {
+				if e != tt.e {
+					t.Error("non DoH endpoint changed")
+				}
+				return
+			}
+			if e.Path != "" {
+				t.Errorf("endpoint path = %s, want it cleared", e.Path)
+			}
+			if again, _ := up.GetEndpoints(context.Background()); again[0] != e {
+				t.Error("endpoint not shared between calls")
+			}
+			// Requests keep the configuration path of the upstream.
+			cp := &connPool{rootCAs: roots}
+			req, _ := http.NewRequest("POST", "https://dns.nextdns.io/abcdef", nil)
+			res, err := cp.roundTrip("example.com", srv.Listener.Addr().String(), e.Path, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			cp.reset()
+			if path != "/abcdef" {
+				t.Errorf("request path = %s, want /abcdef", path)
+			}
+		})
+	}
+}
+
+func TestUpstreamProviderCanceled(t *testing.T) {
+	called := false
+	up := &upstreamProvider{proxy: &Proxy{}, provider: providerFunc(func(ctx context.Context) ([]*endpoint.Endpoint, error) {
+		called = true
+		return nil, errors.New("lookup failed")
+	})}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := up.GetEndpoints(ctx); err != context.Canceled {
+		t.Errorf("GetEndpoints = %v, want %v", err, context.Canceled)
+	}
+	if called {
+		t.Error("provider called with a canceled context")
+	}
+}
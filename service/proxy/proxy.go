@@ -4,21 +4,62 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/windows/netchange"
+	"github.com/nextdns/windows/statsd"
 	tun "github.com/nextdns/windows/tun"
 )
 
+// Startup behaviors for queries received before the upstream is ready.
+const (
+	// StartupDelay delays queries until the upstream is ready or
+	// StartupTimeout is reached, in which case SERVFAIL is returned.
+	StartupDelay = "delay-until-ready"
+	// StartupServFail immediately answers SERVFAIL.
+	StartupServFail = "servfail"
+	// StartupPassthrough sends queries upstream right away, blocking on the
+	// endpoint discovery.
+	StartupPassthrough = "passthrough"
+)
+
+// DefaultStartupTimeout defines the default value for Options StartupTimeout.
+const DefaultStartupTimeout = 5 * time.Second
+
+// Restart retries after the tun interface failed.
+const (
+	// restartDelay is the delay between restart attempts until
+	// StartBackoffThreshold consecutive attempts failed.
+	restartDelay = 5 * time.Second
+
+	// DefaultStartBackoffThreshold defines the default value for Options
+	// StartBackoffThreshold.
+	DefaultStartBackoffThreshold = 3
+
+	// DefaultStartBackoffMax defines the default value for Options
+	// StartBackoffMax.
+	DefaultStartBackoffMax = 5 * time.Minute
+)
+
+// DefaultMaxInflight defines the default value for Options MaxInflight.
+const DefaultMaxInflight = 1024
+
+// DefaultMaxNegativeTTL defines the default value for Options MaxNegativeTTL.
+const DefaultMaxNegativeTTL = 300 * time.Second
+
 const (
 	StateStopped     = "stopped"
 	StateStarting    = "starting"
@@ -27,6 +68,138 @@ const (
 	StateStopping    = "stopping"
 )
 
+// Options holds the proxy settings that can be changed while it is running.
+type Options struct {
+	// StripHTTPSRecords answers HTTPS (type 65) queries with no records so
+	// clients do not use ECH or the other connection hints. SVCB and HTTPS
+	// records are otherwise forwarded untouched. This is meant for
+	// troubleshooting.
+	StripHTTPSRecords bool
+
+	// RotateAnswers rotates the order of A and AAAA records in responses on
+	// each query so clients always picking the first record spread their
+	// load across the addresses of a domain.
+	RotateAnswers bool
+
+	// LocalDomains lists domains, such as the connection-specific search
+	// domain, which names are meant for local resolution. Queries for them
+	// are not sent to NextDNS, avoiding the leak of internal hostnames.
+	LocalDomains []string
+
+	// LocalResolver is the address of a plain DNS server queries for
+	// LocalDomains are forwarded to. If empty, those queries are answered
+	// with NXDOMAIN. The dnsunleak firewall rules permit the traffic of the
+	// service so it can be reached on port 53.
+	LocalResolver string
+
+	// TrackHotNames counts the queried names so the most queried ones can be
+	// exported with HotNames.
+	TrackHotNames bool
+
+	// MirrorUpstream is the URL of a DoH server receiving a copy of each
+	// query. Responses are discarded, and mirroring never delays or fails the
+	// queries sent to NextDNS. As all queries are disclosed to this server,
+	// it must only be set on explicit request of the user.
+	MirrorUpstream string
+
+	// StaticHosts maps hostnames to the IPs used to contact the upstream
+	// servers with their name, so no DNS lookup is needed. Queries for those
+	// hostnames are also answered locally with the IPs.
+	StaticHosts map[string][]string
+
+	// RebindingProtection answers NXDOMAIN to queries for public names which
+	// upstream response has an A or AAAA record in a private, loopback or
+	// link-local network, protecting local services from DNS rebinding
+	// attacks. Private names, LocalDomains and RebindingAllowlist, including
+	// their subdomains, are not checked.
+	RebindingProtection bool
+	RebindingAllowlist  []string
+
+	// AuthoritativeLocal sets the AA flag on the responses generated for
+	// StaticHosts and LocalDomains, so a DNS server forwarding those zones to
+	// the proxy treats it as their authority.
+	AuthoritativeLocal bool
+
+	// RouterRefreshInterval is the interval at which the list of endpoints is
+	// refreshed from the NextDNS router. If zero or negative,
+	// DefaultRouterRefreshInterval is used.
+	RouterRefreshInterval time.Duration
+
+	// RaceBootstrap makes the proxy connect to all the router bootstrap IPs on
+	// start and use the fastest one instead of picking one randomly. It
+	// applies on next start.
+	RaceBootstrap bool
+
+	// StartupBehavior defines how queries received before the upstream is
+	// ready are handled. If empty, StartupDelay is used.
+	StartupBehavior string
+
+	// StartupTimeout is the maximum time a query is delayed with StartupDelay.
+	// If zero or negative, DefaultStartupTimeout is used.
+	StartupTimeout time.Duration
+
+	// NetworkRecovery makes the proxy reset the upstream connections and
+	// re-run the endpoint discovery, trying the active endpoint first, as
+	// soon as the network configuration changes, instead of waiting for
+	// queries to fail after an outage.
+	NetworkRecovery bool
+
+	// SOA defines the SOA record added to locally generated negative
+	// responses. Zero fields take their value from DefaultSOA.
+	SOA SOA
+
+	// MaxNegativeTTL caps the negative caching TTL of NXDOMAIN and NODATA
+	// responses, so names that start resolving are not kept unresolvable by
+	// clients for the SOA minimum of their zone. If zero,
+	// DefaultMaxNegativeTTL is used. A negative value disables it.
+	MaxNegativeTTL time.Duration
+
+	// PreferredRetryInterval is the initial interval at which the endpoint
+	// discovery is retried when it fell back on an endpoint not provided by
+	// the NextDNS router. The interval doubles on each attempt up to
+	// PreferredRetryMaxInterval. If zero or negative,
+	// DefaultPreferredRetryInterval is used.
+	PreferredRetryInterval time.Duration
+
+	// PreferredRetryMaxInterval is the maximum interval between two retries of
+	// the endpoint discovery. If zero or negative,
+	// DefaultPreferredRetryMaxInterval is used.
+	PreferredRetryMaxInterval time.Duration
+
+	// IdleTimeout is the duration without queries after which the upstream
+	// connections are closed, to be re-established with the same endpoint on
+	// the next query. If zero, DefaultIdleTimeout is used. A negative value
+	// disables it.
+	IdleTimeout time.Duration
+
+	// ForwardUnsupportedEDNS forwards queries with an EDNS version higher
+	// than 0 upstream as is. By default, they are answered locally with
+	// BADVERS as required by RFC 6891 so clients retry with EDNS0.
+	ForwardUnsupportedEDNS bool
+
+	// MaxInflight caps the number of queries handled concurrently. Queries
+	// received beyond it are dropped and counted as "dropped" in StatsD so
+	// the process is not exhausted under extreme load. If zero,
+	// DefaultMaxInflight is used.
+	MaxInflight int
+
+	// StartBackoffThreshold is the number of consecutive failed restart
+	// attempts after which the delay between attempts is doubled on each
+	// failure, up to StartBackoffMax, so a persistent failure does not turn
+	// into a tight retry loop. If zero, DefaultStartBackoffThreshold is used.
+	StartBackoffThreshold int
+
+	// StartBackoffMax is the maximum delay between two restart attempts. If
+	// zero, DefaultStartBackoffMax is used.
+	StartBackoffMax time.Duration
+
+	// DSCP is the Differentiated Services Code Point, from 0 to 63, the
+	// upstream connections are marked with for QoS on managed networks. Zero
+	// disables the marking. Windows only applies it if allowed by the system
+	// configuration, a QoS policy being the alternative.
+	DSCP int
+}
+
 type Proxy struct {
 	Upstream string
 
@@ -40,16 +213,112 @@ type Proxy struct {
 	// QueryLog specifies an optional log function called for each received query.
 	QueryLog func(msgID uint16, qname string)
 
+	// TraceLog specifies an optional log function called at each step of
+	// the handling of a query with one of the Trace* events. All the events
+	// of a query share a trace ID, also prefixing the errors reported for
+	// it, so its handling can be followed across log lines.
+	TraceLog func(traceID uint32, msgID uint16, event, detail string)
+
 	// ErrorLog specifies an optional log function for errors. If not set,
 	// errors are not reported.
 	ErrorLog func(error)
 
 	InfoLog func(string)
 
-	mu    sync.Mutex
-	tun   io.ReadWriteCloser
-	state string
-	stop  chan struct{}
+	// StatsD receives the query metrics if not nil.
+	StatsD *statsd.Client
+
+	// OnEndpointsChange is called whenever the list of endpoints returned by
+	// the NextDNS router changes.
+	OnEndpointsChange func(endpoints []string)
+
+	// AllowedUpstreams lists the hostnames or domains, including their
+	// subdomains, the upstreams and forwarders set with SetOptions must
+	// match. IP addresses must be listed as is. When set from outside of the
+	// settings channel, it prevents a compromised GUI from redirecting
+	// queries to another server. If empty, no restriction applies.
+	AllowedUpstreams []string
+
+	// EndpointFile is the path of a file where the active endpoint is
+	// persisted. If set, it is tried first on next start before running the
+	// full discovery, falling back on it if the endpoint fails.
+	EndpointFile string
+
+	// OnRecover is called with the selected endpoint once the endpoint
+	// discovery triggered by a network change completes, see Options
+	// NetworkRecovery.
+	OnRecover func(endpoint string)
+
+	// OnPreferredEndpoint is called when an endpoint provided by the NextDNS
+	// router becomes available after falling back on another endpoint.
+	OnPreferredEndpoint func(endpoint string)
+
+	// OnClockSkew is called when connections to NextDNS fail because of a
+	// certificate validity error, usually caused by a wrong system clock.
+	OnClockSkew func(err error)
+
+	// SummaryInterval is the interval at which a summary of the activity
+	// (queries, blocked queries, errors and active endpoint) is logged to
+	// InfoLog. If zero, no summary is logged.
+	SummaryInterval time.Duration
+
+	// OnStartBackoff is called when the next restart attempt is delayed by
+	// the backoff with the number of consecutive failures so far. Calling
+	// Start resets the backoff and retries immediately.
+	OnStartBackoff func(failures int, delay time.Duration)
+
+	mu            sync.Mutex
+	tun           io.ReadWriteCloser
+	state         string
+	stop          chan struct{}
+	cancel        context.CancelFunc
+	ready         chan struct{} // closed once the upstream is ready, see closeReady
+	startFailures int           // consecutive failed restart attempts
+	retryNow      chan struct{} // closed to skip the current restart delay
+
+	optsMu sync.RWMutex
+	opts   Options
+
+	transportMu     sync.RWMutex
+	transportParent context.Context
+	transportCancel context.CancelFunc
+	activeEndpoint  string
+
+	pool connPool // connections of the transports
+
+	endpointsMu sync.Mutex
+	endpoints   map[string]*endpoint.Endpoint // see sharedEndpoint
+
+	readyMu sync.Mutex
+
+	recoverMu     sync.Mutex
+	recoverCancel context.CancelFunc // cancels the running network recovery
+
+	// testManager replaces nextdnsTransport in unit tests.
+	testManager func(ctx context.Context, first *endpoint.Endpoint) *endpoint.Manager
+
+	rotation uint32 // incremented on each rotated response
+	traceSeq uint32 // incremented on each query to generate trace IDs
+	inflight int32  // queries being handled
+
+	benchmarking int32 // 1 while Benchmark runs
+
+	clockSkewMu   sync.Mutex
+	lastClockSkew time.Time
+
+	mirrorOnce sync.Once
+	mirrorer   *mirrorer
+
+	hotNames hotNames
+
+	idleMu    sync.Mutex
+	lastQuery time.Time
+	idle      bool // transport torn down since lastQuery
+
+	activity activity // counts for the summary log
+
+	bootstrapMu     sync.Mutex
+	fastestRouterIP string // selected by raceBootstrap
 
 	dedup dedup
 }
@@ -64,16 +333,80 @@ func (p *Proxy) SetDeviceInfo(name, model, id, version string) {
 		reportHdr = http.Header{}
 		p.ExtraHeaders = reportHdr
 	}
-	if name != "" {
-		reportHdr.Set("X-Device-Name", name)
+	// Remove previous values when not set so disabling reporting applies to
+	// the next requests.
+	for hdr, v := range map[string]string{
+		"X-Device-Name":  name,
+		"X-Device-Model": model,
+		"X-Device-Id":    id,
+	} {
+		if v != "" {
+			reportHdr.Set(hdr, v)
+		} else {
+			reportHdr.Del(hdr)
+		}
+	}
+	reportHdr.Set("User-Agent", "nextdns-windows/"+version)
+}
+
+// CheckOptions returns an error if an upstream of o does not match
+// AllowedUpstreams or StaticHosts, StartupBehavior, the SOA names,
+// MaxNegativeTTL or DSCP are invalid.
+func (p *Proxy) CheckOptions(o Options) error {
+	if o.DSCP < 0 || o.DSCP > 63 {
+		return fmt.Errorf("invalid DSCP value: %d", o.DSCP)
+	}
+	// TTLs are whole seconds up to 2^31-1 (RFC 2181).
+	if o.MaxNegativeTTL > 0 && (o.MaxNegativeTTL < time.Second || o.MaxNegativeTTL > math.MaxInt32*time.Second) {
+		return fmt.Errorf("invalid max negative TTL: %v", o.MaxNegativeTTL)
 	}
-	if model != "" {
-		reportHdr.Set("X-Device-Model", model)
+	switch o.StartupBehavior {
+	case "", StartupDelay, StartupServFail, StartupPassthrough:
+	default:
+		return fmt.Errorf("invalid startup behavior: %s", o.StartupBehavior)
 	}
-	if id != "" {
-		reportHdr.Set("X-Device-Id", id)
+	for _, name := range []string{o.SOA.MName, o.SOA.RName} {
+		if _, err := appendName(nil, name); name != "" && err != nil {
+			return fmt.Errorf("invalid SOA name %q: %v", name, err)
+		}
 	}
-	reportHdr.Set("User-Agent", "nextdns-windows/"+version)
+	if err := p.checkUpstream(o.MirrorUpstream); err != nil {
+		return err
+	}
+	if err := p.checkUpstream(o.LocalResolver); err != nil {
+		return err
+	}
+	_, err := normalizeStaticHosts(o.StaticHosts)
+	return err
+}
+
+// SetOptions changes the options of the proxy, taking effect on next queries.
+// If o does not pass CheckOptions, an error is returned and the options are
+// left unchanged.
+func (p *Proxy) SetOptions(o Options) error {
+	if err := p.CheckOptions(o); err != nil {
+		return err
+	}
+	o.StaticHosts, _ = normalizeStaticHosts(o.StaticHosts)
+	p.optsMu.Lock()
+	p.opts = o
+	p.optsMu.Unlock()
+	if p.pool.setDSCP(o.DSCP) {
+		// The marking is set when dialing.
+		n := p.pool.reset()
+		if o.DSCP != 0 {
+			p.logInfo(fmt.Sprintf("Marking upstream connections with DSCP %d, reset %d connections", o.DSCP, n))
+		} else {
+			p.logInfo(fmt.Sprintf("Upstream connections no longer marked with DSCP, reset %d connections", n))
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) options() Options {
+	p.optsMu.RLock()
+	defer p.optsMu.RUnlock()
+	return p.opts
 }
 
 func (p *Proxy) State() string {
@@ -100,63 +433,414 @@ func (p *Proxy) setStateLocked(s string) {
 }
 
 func (p *Proxy) Start() (err error) {
+	if p.State() == StateStopped {
+		// Race before taking the lock as it may take up to
+		// bootstrapRaceTimeout.
+		d := &net.Dialer{}
+		p.raceBootstrap(d.DialContext)
+	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if p.stateLocked() != StateStopped {
+	p.startFailures = 0
+	switch p.stateLocked() {
+	case StateStopped:
+	case StateReasserting:
+		// Explicit start while restarting: reset the backoff and retry now.
+		if p.retryNow != nil {
+			close(p.retryNow)
+			p.retryNow = nil
+		}
+		return nil
+	default:
 		return nil // already started
 	}
 	p.setStateLocked(StateStarting)
-	return p.startLocked()
+	if err = p.startLocked(); err != nil {
+		// Allow starting again.
+		p.setStateLocked(StateStopped)
+	}
+	return err
 }
 
 func (p *Proxy) startLocked() (err error) {
 	if p.tun, err = tun.OpenTunDevice("tun0", "192.0.2.43", "192.0.2.42", "255.255.255.0", []string{"192.0.2.42"}); err != nil {
 		return err
 	}
-	p.Transport = p.nextdnsTransport()
-	go p.run()
+	if p.cancel != nil {
+		p.cancel()
+	}
+	var ctx context.Context
+	ctx, p.cancel = context.WithCancel(context.Background())
+	p.ready = p.newTransport(ctx, p.loadEndpoint())
+	go p.watchNetwork(ctx)
+	if p.SummaryInterval > 0 {
+		go p.logSummary(ctx)
+	}
+	p.touch()
+	go p.watchIdle(ctx)
+	go p.run(ctx)
+	return nil
+}
+
+// newTransport replaces the transport with a new endpoint.Manager and starts
+// the endpoint discovery in the background so queries can be sent as soon as
+// possible. In-flight queries complete using the previous transport. The
+// returned channel is closed once an endpoint is selected. If first is not nil,
+// it is tried before running the full discovery.
+func (p *Proxy) newTransport(ctx context.Context, first *endpoint.Endpoint) chan struct{} {
+	m, ctx := p.replaceTransport(ctx, first)
+	ready := make(chan struct{})
+	go func() {
+		if err := m.Test(ctx); err == nil {
+			p.closeReady(ready)
+		}
+	}()
+	return ready
+}
+
+// closeReady closes ready unless it is already closed, the initial endpoint
+// discovery and a network recovery both marking the upstream as ready.
+func (p *Proxy) closeReady(ready chan struct{}) {
+	p.readyMu.Lock()
+	defer p.readyMu.Unlock()
+	select {
+	case <-ready:
+	default:
+		close(ready)
+	}
+}
+
+// replaceTransport replaces the transport with a new endpoint.Manager which
+// selects an endpoint on first use. The returned context is canceled when the
+// transport gets replaced or closed.
+func (p *Proxy) replaceTransport(ctx context.Context, first *endpoint.Endpoint) (*endpoint.Manager, context.Context) {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	m := p.manager(ctx, first)
+	p.transportMu.Lock()
+	defer p.transportMu.Unlock()
+	if p.transportCancel != nil {
+		p.transportCancel()
+	}
+	p.transportParent = parent
+	p.transportCancel = cancel
+	p.Transport = &upstreamTransport{manager: m, pool: &p.pool}
+	return m, ctx
+}
+
+// recoverTransport resets the upstream connections, which may be stale after
+// a network change, and runs the endpoint discovery of a new transport trying
+// first before the other endpoints. The new transport replaces the current one
+// once an endpoint is selected, so queries are not delayed by the discovery.
+// An error is returned if ctx is done or the transport is replaced or closed
+// before.
+func (p *Proxy) recoverTransport(ctx context.Context, first *endpoint.Endpoint) error {
+	p.transportMu.RLock()
+	started := p.transportCancel != nil
+	p.transportMu.RUnlock()
+	if !started {
+		return errors.New("proxy not started")
+	}
+	p.pool.reset()
+	if err := p.swapTransport(ctx, first, nil); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	ready := p.ready
+	p.mu.Unlock()
+	if ready != nil {
+		p.closeReady(ready)
+	}
+	return nil
+}
+
+// errEndpointRejected is returned by swapTransport when accept rejects the
+// selected endpoint.
+var errEndpointRejected = errors.New("endpoint rejected")
+
+// swapTransport runs the endpoint discovery of a new transport trying first
+// and replaces the current transport with it once an endpoint is selected, if
+// accept is nil or returns true for this endpoint. The discovery is not run on
+// the current transport as endpoint.Manager holds its lock meanwhile, stalling
+// the queries. ctx is only used for the discovery. An error is returned if ctx
+// is done, the endpoint is rejected or the transport is replaced or closed
+// before.
+func (p *Proxy) swapTransport(ctx context.Context, first *endpoint.Endpoint, accept func(e *endpoint.Endpoint) bool) error {
+	p.transportMu.RLock()
+	parent := p.transportParent
+	started := p.transportCancel != nil
+	p.transportMu.RUnlock()
+	if !started {
+		return errors.New("proxy not started")
+	}
+	// The transport context must outlive ctx, only used for the discovery.
+	tctx, cancel := context.WithCancel(parent)
+	m := p.manager(tctx, first)
+	testCtx, testCancel := context.WithCancel(tctx)
+	defer testCancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			testCancel()
+		case <-testCtx.Done():
+		}
+	}()
+	if err := m.Test(testCtx); err != nil {
+		cancel()
+		return err
+	}
+	if accept != nil {
+		var selected *endpoint.Endpoint
+		_ = m.Do(testCtx, func(e *endpoint.Endpoint) error {
+			selected = e
+			return nil
+		})
+		if selected == nil || !accept(selected) {
+			cancel()
+			return errEndpointRejected
+		}
+	}
+	p.transportMu.Lock()
+	if p.transportCancel == nil || p.transportParent != parent {
+		p.transportMu.Unlock()
+		cancel()
+		return errors.New("transport replaced during discovery")
+	}
+	p.transportCancel()
+	p.transportCancel = cancel
+	p.Transport = &upstreamTransport{manager: m, pool: &p.pool}
+	p.transportMu.Unlock()
+	return nil
+}
+
+// ResetConnections closes the upstream connections, which may be stale, so the
+// next queries are sent to the currently selected endpoint on new ones.
+// In-flight queries complete on their connection, closed afterwards. The number
+// of connections reset is returned.
+func (p *Proxy) ResetConnections() (int, error) {
+	if p.transport() == nil {
+		return 0, errors.New("proxy not started")
+	}
+	n := p.pool.reset()
+	p.logInfo(fmt.Sprintf("Reset %d upstream connections to %s", n, p.ActiveEndpoint()))
+	return n, nil
+}
+
+// switchEndpoint replaces the transport with a new one trying e first. If e is
+// empty, the regular discovery is run.
+func (p *Proxy) switchEndpoint(e string) error {
+	p.transportMu.RLock()
+	parent := p.transportParent
+	started := p.transportCancel != nil
+	p.transportMu.RUnlock()
+	if !started {
+		return errors.New("proxy not started")
+	}
+	var first *endpoint.Endpoint
+	if e != "" {
+		var err error
+		if first, err = endpoint.New(e); err != nil {
+			return err
+		}
+	}
+	p.replaceTransport(parent, first)
 	return nil
 }
 
+func (p *Proxy) closeTransport() {
+	p.transportMu.Lock()
+	defer p.transportMu.Unlock()
+	if p.transportCancel != nil {
+		p.transportCancel()
+		p.transportCancel = nil
+	}
+	p.Transport = nil
+	p.activeEndpoint = ""
+}
+
+func (p *Proxy) transport() http.RoundTripper {
+	p.transportMu.RLock()
+	defer p.transportMu.RUnlock()
+	return p.Transport
+}
+
+func (p *Proxy) setActiveEndpoint(e string) {
+	p.transportMu.Lock()
+	defer p.transportMu.Unlock()
+	p.activeEndpoint = e
+}
+
+// ActiveEndpoint returns the endpoint currently used to send queries, or an
+// empty string if none is selected yet.
+func (p *Proxy) ActiveEndpoint() string {
+	p.transportMu.RLock()
+	defer p.transportMu.RUnlock()
+	return p.activeEndpoint
+}
+
+// watchNetwork calls onNetworkChange each time the network configuration
+// changes, until ctx is done.
+func (p *Proxy) watchNetwork(ctx context.Context) {
+	err := netchange.Watch(ctx, func() {
+		p.onNetworkChange(ctx)
+	})
+	if err != nil {
+		p.logErr(fmt.Errorf("network change watch: %v", err))
+	}
+}
+
+// onNetworkChange starts the recovery of the transport in the background if
+// Options NetworkRecovery is set, canceling the one started by a previous
+// change if still running. OnRecover is called once it completes.
+func (p *Proxy) onNetworkChange(ctx context.Context) {
+	if !p.options().NetworkRecovery {
+		return
+	}
+	p.logInfo("Network change detected, re-running endpoint discovery")
+	var first *endpoint.Endpoint
+	if e := p.ActiveEndpoint(); e != "" {
+		// Endpoints which cannot be parsed back, such as plain DNS ones, just
+		// get the full discovery.
+		first, _ = endpoint.New(e)
+	}
+	p.recoverMu.Lock()
+	if p.recoverCancel != nil {
+		p.recoverCancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	p.recoverCancel = cancel
+	p.recoverMu.Unlock()
+	go func() {
+		defer cancel()
+		if err := p.recoverTransport(ctx, first); err != nil {
+			if ctx.Err() == nil {
+				p.logErr(fmt.Errorf("network recovery: %v", err))
+			}
+			return
+		}
+		if p.OnRecover != nil {
+			p.OnRecover(p.ActiveEndpoint())
+		}
+	}()
+}
+
+// waitReady waits for the upstream to be ready according to StartupBehavior
+// and returns false if the query should be answered with SERVFAIL.
+func (p *Proxy) waitReady(qname string) bool {
+	p.mu.Lock()
+	ready := p.ready
+	p.mu.Unlock()
+	if ready == nil {
+		return true
+	}
+	select {
+	case <-ready:
+		return true
+	default:
+	}
+	opts := p.options()
+	switch opts.StartupBehavior {
+	case StartupPassthrough:
+		return true
+	case StartupServFail:
+		return false
+	}
+	timeout := opts.StartupTimeout
+	if timeout <= 0 {
+		timeout = DefaultStartupTimeout
+	}
+	p.logInfo(fmt.Sprintf("Delaying query for %s until upstream is ready", qname))
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// manager returns the endpoint.Manager of a new transport, see
+// nextdnsTransport.
+func (p *Proxy) manager(ctx context.Context, first *endpoint.Endpoint) *endpoint.Manager {
+	if p.testManager != nil {
+		return p.testManager(ctx, first)
+	}
+	return p.nextdnsTransport(ctx, first)
+}
+
 // nextdnsTransport returns a endpoint.Manager configured to connect to NextDNS
-// using different steering techniques.
-func (p *Proxy) nextdnsTransport() http.RoundTripper {
-	return &endpoint.Manager{
+// using different steering techniques. The list of endpoints provided by the
+// router is refreshed in the background until ctx is done. If first is not
+// nil, it is tried before running the regular discovery.
+func (p *Proxy) nextdnsTransport(ctx context.Context, first *endpoint.Endpoint) *endpoint.Manager {
+	var retrying int32
+	routerIP := p.routerBootstrapIP()
+	router := &routerProvider{
+		source: &endpoint.SourceURLProvider{
+			SourceURL: "https://router.nextdns.io",
+			Client: &http.Client{
+				// Trick to avoid depending on DNS to contact the router API.
+				Transport: p.pool.endpoint(endpoint.MustNew("https://router.nextdns.io#" + routerIP)),
+			},
+		},
+		onChange: func(endpoints []*endpoint.Endpoint) {
+			if p.OnEndpointsChange != nil {
+				names := make([]string, 0, len(endpoints))
+				for _, e := range endpoints {
+					names = append(names, e.String())
+				}
+				p.OnEndpointsChange(names)
+			}
+			// Re-run the discovery so new endpoints are considered and
+			// decommissioned ones are abandoned.
+			go func() {
+				if err := p.swapTransport(ctx, nil, nil); err != nil && ctx.Err() == nil {
+					p.logErr(fmt.Errorf("endpoints change: %v", err))
+				}
+			}()
+		},
+	}
+	go router.run(ctx, p.routerRefreshInterval, func(err error) {
+		p.logErr(fmt.Errorf("router refresh: %v", err))
+	})
+	m := &endpoint.Manager{
 		Providers: []endpoint.Provider{
+			// Try the given endpoint first.
+			&upstreamProvider{proxy: p, provider: &onceProvider{e: first}},
 			// Prefer unicast routing.
-			&endpoint.SourceURLProvider{
-				SourceURL: "https://router.nextdns.io",
-				Client: &http.Client{
-					// Trick to avoid depending on DNS to contact the router API.
-					Transport: endpoint.MustNew(fmt.Sprintf("https://router.nextdns.io#%s", []string{
-						"216.239.32.21",
-						"216.239.34.21",
-						"216.239.36.21",
-						"216.239.38.21",
-					}[rand.Intn(3)])),
-				},
-			},
+			&upstreamProvider{proxy: p, provider: router},
 			// Fallback on anycast.
-			endpoint.StaticProvider([]*endpoint.Endpoint{
+			&upstreamProvider{proxy: p, provider: endpoint.StaticProvider([]*endpoint.Endpoint{
 				endpoint.MustNew("https://dns1.nextdns.io#45.90.28.0"),
 				endpoint.MustNew("https://dns2.nextdns.io#45.90.30.0"),
-			}),
+			})},
 			// Fallback on CDN fronting.
-			endpoint.StaticProvider([]*endpoint.Endpoint{
+			&upstreamProvider{proxy: p, provider: endpoint.StaticProvider([]*endpoint.Endpoint{
 				endpoint.MustNew("https://d1xovudkxbl47e.cloudfront.net"),
-			}),
+			})},
 		},
 		OnError: func(e *endpoint.Endpoint, err error) {
+			p.checkClockSkew(err)
 			if p.ErrorLog != nil {
 				p.ErrorLog(fmt.Errorf("Endpoint failed: %s: %v", e.Hostname, err))
 			}
 		},
 		OnChange: func(e *endpoint.Endpoint) {
+			p.setActiveEndpoint(e.String())
+			p.saveEndpoint(e.String())
+			if !router.contains(e) && atomic.CompareAndSwapInt32(&retrying, 0, 1) {
+				go func() {
+					p.retryPreferred(ctx, router)
+					atomic.StoreInt32(&retrying, 0)
+				}()
+			}
 			if p.InfoLog != nil {
 				p.InfoLog(fmt.Sprintf("Switching endpoint: %s", e.Hostname))
 			}
 		},
 	}
+	return m
 }
 
 func (p *Proxy) Stop() (err error) {
@@ -167,6 +851,18 @@ func (p *Proxy) Stop() (err error) {
 		return nil // already stopped
 	}
 	p.setStateLocked(StateStopping)
+	if p.retryNow != nil {
+		// Restarting, stop waiting for the next attempt.
+		close(p.retryNow)
+		p.retryNow = nil
+	}
+	// Cancel first as it kills dnsunleak, restoring the firewall rules, so
+	// the system is left in a good state even if we get killed while
+	// stopping.
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
 	if p.tun != nil {
 		err = p.tun.Close()
 		p.tun = nil
@@ -175,7 +871,8 @@ func (p *Proxy) Stop() (err error) {
 		close(p.stop)
 		p.stop = nil
 	}
-	p.Transport = nil
+	p.closeTransport()
+	p.ready = nil
 	return err
 }
 
@@ -191,16 +888,68 @@ func (p *Proxy) restartOrStop() {
 		return
 	}
 	p.setStateLocked(StateReasserting)
+	p.tun = nil // closed by run
 	for {
-		time.Sleep(5 * time.Second)
+		delay := p.restartDelayLocked()
+		retry := make(chan struct{})
+		p.retryNow = retry
+		// Release the lock while waiting so the proxy can be stopped or
+		// started explicitly.
+		p.mu.Unlock()
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-retry:
+			t.Stop()
+		}
+		p.mu.Lock()
+		p.retryNow = nil
+		switch p.stateLocked() {
+		case StateReasserting:
+		case StateStopping:
+			p.setStateLocked(StateStopped)
+			return
+		default:
+			return
+		}
 		if err := p.startLocked(); err != nil {
+			p.startFailures++
 			p.logErr(fmt.Errorf("restart err: %v", err))
 			continue
 		}
+		p.startFailures = 0
 		break
 	}
 }
 
+// restartDelayLocked returns the delay before the next restart attempt,
+// reporting it to OnStartBackoff when the backoff applies.
+func (p *Proxy) restartDelayLocked() time.Duration {
+	opts := p.options()
+	threshold := opts.StartBackoffThreshold
+	if threshold <= 0 {
+		threshold = DefaultStartBackoffThreshold
+	}
+	if p.startFailures < threshold {
+		return restartDelay
+	}
+	max := opts.StartBackoffMax
+	if max <= 0 {
+		max = DefaultStartBackoffMax
+	}
+	delay := restartDelay
+	for i := threshold; i <= p.startFailures && delay < max; i++ {
+		delay <<= 1
+	}
+	if delay > max {
+		delay = max
+	}
+	if p.OnStartBackoff != nil {
+		p.OnStartBackoff(p.startFailures, delay)
+	}
+	return delay
+}
+
 // doStart transitions to StateStarted. If the previous state wasn't
 // StateStarting or StateReassessing, no transition happens and false is
 // returned.
@@ -233,13 +982,13 @@ func (p *Proxy) logErr(err error) {
 	}
 }
 
-func (p *Proxy) run() {
+func (p *Proxy) run(ctx context.Context) {
 	defer p.restartOrStop()
 
 	// Setup firewall rules to avoid DNS leaking.
 	// The process block forever and removes rules when killed.
 	// We thus kill it as soon as we stop the proxy.
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	if err := p.unleak(ctx); err != nil {
 		p.logErr(fmt.Errorf("cannot start dnsunleak: %v", err))
@@ -333,35 +1082,205 @@ func (p *Proxy) run() {
 			// Skip duplicated query.
 			continue
 		}
+		if !p.acquireInflight() {
+			bpool.Put(&buf)
+			p.StatsD.Count("dropped", 1)
+			continue
+		}
 		go func() {
-			qname := lazyQName(buf)
-			p.logQuery(msgID, qname)
-			res, err := p.resolve(buf)
+			defer p.releaseInflight()
+			traceID := atomic.AddUint32(&p.traceSeq, 1)
+			rsize, err := p.handleQuery(ctx, traceID, msgID, buf)
 			if err != nil {
-				p.logErr(fmt.Errorf("resolve: %x %v", msgID, err))
-				return
-			}
-			buf = buf[:maxSize] // reset buf size to it's underlaying size
-			rsize, err := readDNSResponse(res, buf)
-			if err != nil {
-				p.logErr(fmt.Errorf("readDNSResponse: %v", err))
+				p.activity.add(1, 0, 1)
+				p.logErr(fmt.Errorf("query %08x: %w", traceID, err))
 				return
 			}
+			p.activity.add(1, 0, 0)
+			buf = buf[:rsize]
 			select {
-			case packetOut <- buf[:rsize]:
+			case packetOut <- buf:
 			case <-p.stop:
 			}
 		}()
 	}
 }
 
+// acquireInflight reserves a slot for a query about to be handled, and returns
+// false if MaxInflight queries are already in flight. Slots must be released
+// with releaseInflight.
+func (p *Proxy) acquireInflight() bool {
+	max := p.options().MaxInflight
+	if max <= 0 {
+		max = DefaultMaxInflight
+	}
+	if atomic.AddInt32(&p.inflight, 1) > int32(max) {
+		atomic.AddInt32(&p.inflight, -1)
+		return false
+	}
+	return true
+}
+
+func (p *Proxy) releaseInflight() {
+	atomic.AddInt32(&p.inflight, -1)
+}
+
+// handleQuery answers the query packet buf and writes the response packet back
+// to buf, reusing its underlying array. The size of the response is returned.
+// Forwarding to LocalResolver is aborted once ctx is done.
+func (p *Proxy) handleQuery(ctx context.Context, traceID uint32, msgID uint16, buf []byte) (int, error) {
+	q := dnsMessage(buf)
+	if q == nil {
+		return -1, fmt.Errorf("invalid query: %x", msgID)
+	}
+	rd := q[2]&0x01 != 0 // kept as q is overwritten by forwarded responses
+	p.touch()
+	qname := lazyQName(buf)
+	p.logQuery(msgID, qname)
+	p.trace(traceID, msgID, TraceReceive, qname)
+	// As a stub forwarder, we do not forward zone management messages.
+	switch opcode(q) {
+	case opcodeNotify:
+		p.logInfo(fmt.Sprintf("Received NOTIFY for %s, client may be misconfigured", qname))
+		return p.answer(traceID, msgID, buf, emptyResponse(q, rcodeNotImp), "notify"), nil
+	case opcodeUpdate:
+		p.logInfo(fmt.Sprintf("Received UPDATE for %s, client may be misconfigured", qname))
+		return p.answer(traceID, msgID, buf, emptyResponse(q, rcodeRefused), "update"), nil
+	}
+	opts := p.options()
+	if !opts.ForwardUnsupportedEDNS {
+		if v, ok := ednsVersion(q); ok && v > ednsVersionSupported {
+			p.logInfo(fmt.Sprintf("Received EDNS version %d query for %s, answering BADVERS", v, qname))
+			return p.answer(traceID, msgID, buf, badVersResponse(q), "badvers"), nil
+		}
+	}
+	if opts.TrackHotNames {
+		p.hotNames.add(qname)
+	}
+	if opts.StripHTTPSRecords {
+		if qtype, err := questionType(q); err == nil && qtype == typeHTTPS {
+			return p.answer(traceID, msgID, buf, negativeResponse(q, rcodeNoError, opts.SOA), "strip-https"), nil
+		}
+	}
+	if len(opts.StaticHosts) > 0 {
+		if qtype, err := questionType(q); err == nil && (qtype == typeA || qtype == typeAAAA) {
+			if ips := opts.StaticHosts[strings.ToLower(strings.TrimSuffix(qname, "."))]; len(ips) > 0 {
+				res := staticResponse(q, qtype, ips, opts.SOA)
+				if opts.AuthoritativeLocal {
+					setAuthoritative(res)
+				}
+				return p.answer(traceID, msgID, buf, res, "static-host"), nil
+			}
+		}
+	}
+	if matchDomain(qname, opts.LocalDomains) {
+		if opts.LocalResolver == "" {
+			res := negativeResponse(q, rcodeNXDomain, opts.SOA)
+			if opts.AuthoritativeLocal {
+				setAuthoritative(res)
+			}
+			return p.answer(traceID, msgID, buf, res, "local-domain"), nil
+		}
+		p.trace(traceID, msgID, TraceForward, opts.LocalResolver)
+		q = append([]byte(nil), q...) // buf is reused for the response
+		n, err := forwardDNS53(ctx, opts.LocalResolver, q, buf[28:cap(buf)])
+		if err != nil {
+			return -1, fmt.Errorf("forward: %x %v", msgID, err)
+		}
+		setResponseFlags(buf[28:28+n], rd)
+		p.trace(traceID, msgID, TraceResponse, rcodeName(buf[28:28+n]))
+		return responsePacket(buf, n), nil
+	}
+	if !p.waitReady(qname) {
+		return p.answer(traceID, msgID, buf, emptyResponse(q, rcodeServFail), "not-ready"), nil
+	}
+	if opts.MirrorUpstream != "" {
+		p.mirrorOnce.Do(func() {
+			p.mirrorer = newMirrorer()
+		})
+		p.mirrorer.mirror(opts.MirrorUpstream, q, p.logErr)
+	}
+	p.StatsD.Count("queries", 1)
+	p.trace(traceID, msgID, TraceUpstream, p.ActiveEndpoint())
+	start := time.Now()
+	rsize, err := p.forward(msgID, buf)
+	if err != nil {
+		p.StatsD.Count("errors", 1)
+		p.checkClockSkew(err)
+		return -1, err
+	}
+	p.StatsD.Timing("latency", time.Since(start))
+	// The upstream answers with the response packet.
+	res := dnsMessage(buf[:rsize])
+	if res == nil {
+		return -1, fmt.Errorf("invalid response: %x", msgID)
+	}
+	setResponseFlags(res, rd)
+	if isBlockedResponse(res) {
+		p.StatsD.Count("blocked.server", 1)
+		p.activity.add(0, 1, 0)
+		p.trace(traceID, msgID, TraceBlocked, qname)
+	}
+	if opts.RebindingProtection {
+		allowed := append(append([]string(nil), opts.LocalDomains...), opts.RebindingAllowlist...)
+		if nx := p.rebindingResponse(res, qname, allowed); nx != nil {
+			p.StatsD.Count("blocked.rebinding", 1)
+			p.activity.add(0, 1, 0)
+			p.trace(traceID, msgID, TraceLocal, "rebinding")
+			p.trace(traceID, msgID, TraceResponse, rcodeName(nx))
+			// buf already holds the response packet, only its message is
+			// replaced.
+			return resizePacket(buf, copy(buf[28:cap(buf)], nx)), nil
+		}
+	}
+	if maxTTL := p.maxNegativeTTL(); maxTTL >= 0 {
+		_ = capNegativeTTL(res, uint32(maxTTL/time.Second))
+	}
+	if opts.RotateAnswers {
+		_ = rotateAnswers(res, int(atomic.AddUint32(&p.rotation, 1)))
+	}
+	p.trace(traceID, msgID, TraceResponse, rcodeName(res))
+	return rsize, nil
+}
+
+func (p *Proxy) routerRefreshInterval() time.Duration {
+	if interval := p.options().RouterRefreshInterval; interval > 0 {
+		return interval
+	}
+	return DefaultRouterRefreshInterval
+}
+
+func (p *Proxy) maxNegativeTTL() time.Duration {
+	if ttl := p.options().MaxNegativeTTL; ttl != 0 {
+		return ttl
+	}
+	return DefaultMaxNegativeTTL
+}
+
+// forward sends the query packet buf upstream and writes the response back to
+// buf.
+func (p *Proxy) forward(msgID uint16, buf []byte) (int, error) {
+	res, err := p.resolve(buf)
+	if err != nil {
+		return -1, fmt.Errorf("resolve: %x %w", msgID, err)
+	}
+	defer res.Close()
+	buf = buf[:cap(buf)] // reset buf size to it's underlaying size
+	rsize, err := readDNSResponse(res, buf)
+	if err != nil {
+		return -1, fmt.Errorf("readDNSResponse: %v", err)
+	}
+	return rsize, nil
+}
+
 func (p *Proxy) unleak(ctx context.Context) error {
 	// Setup firewall rules to avoid DNS leaking.
 	// The process block forever and removes rules when killed.
 	// We thus kill it as soon as we stop the proxy.
+	// The service itself is permitted to send queries to LocalResolver.
 	ex, _ := os.Executable()
 	dnsunleakPath := filepath.Join(filepath.Dir(ex), "dnsunleak.exe")
-	cmd := exec.CommandContext(ctx, dnsunleakPath)
+	cmd := exec.CommandContext(ctx, dnsunleakPath, ex)
 	stdout, stdoutW := io.Pipe()
 	stdinR, stdin := io.Pipe()
 	cmd.Stdin = stdinR
@@ -394,7 +1313,7 @@ func (p *Proxy) resolve(buf []byte) (io.ReadCloser, error) {
 	for name, hdrs := range p.ExtraHeaders {
 		req.Header[name] = hdrs
 	}
-	rt := p.Transport
+	rt := p.transport()
 	if rt == nil {
 		rt = http.DefaultTransport
 	}
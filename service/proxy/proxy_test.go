@@ -0,0 +1,791 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/windows/statsd"
+)
+
+// upstreamFunc is a DoH transport answering each query packet with the
+// response packet built from the DNS message returned by the function.
+type upstreamFunc func(q []byte) []byte
+
+func (f upstreamFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	pkt, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	res := f(append([]byte(nil), pkt[28:]...))
+	buf := make([]byte, 0, 1500)
+	buf = append(buf, pkt...)
+	n := responsePacket(buf, copy(buf[28:cap(buf)], res))
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(buf[:n])),
+	}, nil
+}
+
+// testProxy returns a proxy with opts forwarding queries to upstream, which
+// receives the queries it is sent.
+func testProxy(t *testing.T, opts Options, upstream upstreamFunc) (*Proxy, *[][]byte) {
+	t.Helper()
+	var forwarded [][]byte
+	p := &Proxy{
+		Upstream: "https://dns.example.com/abcdef",
+		Transport: upstreamFunc(func(q []byte) []byte {
+			forwarded = append(forwarded, q)
+			return upstream(q)
+		}),
+	}
+	if err := p.SetOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	return p, &forwarded
+}
+
+// answerA returns a response to q with ips as A or AAAA answers.
+func answerA(q []byte, ips ...string) []byte {
+	qtype, _ := questionType(q)
+	return staticResponse(q, qtype, ips, SOA{})
+}
+
+// handle runs q through handleQuery as received from the tun interface and
+// returns the DNS message of the response packet.
+func handle(t *testing.T, p *Proxy, q []byte) []byte {
+	t.Helper()
+	buf := make([]byte, 0, 1500)
+	buf = append(buf, queryPacket(q)...)
+	n, err := p.handleQuery(context.Background(), 1, lazyMsgID(buf), buf)
+	if err != nil {
+		t.Fatalf("handleQuery: %v", err)
+	}
+	return checkResponsePacket(t, buf[:n])
+}
+
+func TestWaitReady(t *testing.T) {
+	closed := make(chan struct{})
+	close(closed)
+	tests := []struct {
+		name     string
+		ready    chan struct{}
+		opts     Options
+		want     bool
+		minDelay time.Duration
+	}{
+		{"no transport", nil, Options{}, true, 0},
+		{"ready", closed, Options{StartupBehavior: StartupServFail}, true, 0},
+		{"servfail", make(chan struct{}), Options{StartupBehavior: StartupServFail}, false, 0},
+		{"passthrough", make(chan struct{}), Options{StartupBehavior: StartupPassthrough}, true, 0},
+		{"delay timeout", make(chan struct{}), Options{StartupTimeout: 50 * time.Millisecond}, false, 50 * time.Millisecond},
+		{"explicit delay timeout", make(chan struct{}), Options{StartupBehavior: StartupDelay, StartupTimeout: 50 * time.Millisecond}, false, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{}
+			if err := p.SetOptions(tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			p.ready = tt.ready
+			start := time.Now()
+			if got := p.waitReady("example.com."); got != tt.want {
+				t.Errorf("waitReady = %v, want %v", got, tt.want)
+			}
+			if d := time.Since(start); d < tt.minDelay {
+				t.Errorf("returned after %v, want at least %v", d, tt.minDelay)
+			}
+		})
+	}
+}
+
+func TestWaitReadyDelayUntilReady(t *testing.T) {
+	p := &Proxy{}
+	ready := make(chan struct{})
+	p.ready = ready
+	time.AfterFunc(20*time.Millisecond, func() { close(ready) })
+	if !p.waitReady("example.com.") {
+		t.Error("waitReady = false once ready, want true")
+	}
+}
+
+func TestCheckOptionsStartupBehavior(t *testing.T) {
+	p := &Proxy{}
+	for _, b := range []string{"", StartupDelay, StartupServFail, StartupPassthrough} {
+		if err := p.CheckOptions(Options{StartupBehavior: b}); err != nil {
+			t.Errorf("%q: %v", b, err)
+		}
+	}
+	if err := p.CheckOptions(Options{StartupBehavior: "wait"}); err == nil {
+		t.Error("invalid behavior accepted")
+	}
+}
+
+func TestCheckOptionsDSCP(t *testing.T) {
+	tests := []struct {
+		dscp    int
+		wantErr bool
+	}{
+		{0, false},
+		{46, false},
+		{63, false},
+		{-1, true},
+		{64, true},
+	}
+	p := &Proxy{}
+	for _, tt := range tests {
+		if err := p.CheckOptions(Options{DSCP: tt.dscp}); (err != nil) != tt.wantErr {
+			t.Errorf("CheckOptions(DSCP %d) = %v, want error %v", tt.dscp, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckOptionsMaxNegativeTTL(t *testing.T) {
+	tests := []struct {
+		ttl     time.Duration
+		wantErr bool
+	}{
+		{0, false},
+		{-1, false},
+		{time.Second, false},
+		{time.Hour, false},
+		{time.Millisecond, true},
+		{math.MaxUint32 * time.Second, true},
+	}
+	p := &Proxy{}
+	for _, tt := range tests {
+		if err := p.CheckOptions(Options{MaxNegativeTTL: tt.ttl}); (err != nil) != tt.wantErr {
+			t.Errorf("CheckOptions(MaxNegativeTTL %v) = %v, want error %v", tt.ttl, err, tt.wantErr)
+		}
+	}
+}
+
+func TestHandleQueryZoneManagement(t *testing.T) {
+	tests := []struct {
+		name      string
+		opcode    int
+		wantRcode int
+	}{
+		{"notify", opcodeNotify, rcodeNotImp},
+		{"update", opcodeUpdate, rcodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := mkQuery(t, "example.com", typeSOA, -1)
+			q[2] = byte(tt.opcode<<3) | q[2]&0x01
+			res := handle(t, &Proxy{}, q)
+			if rcode(res) != tt.wantRcode {
+				t.Errorf("rcode = %d, want %d", rcode(res), tt.wantRcode)
+			}
+			if opcode(res) != tt.opcode {
+				t.Errorf("opcode = %d, want %d", opcode(res), tt.opcode)
+			}
+			if res[2]&0x80 == 0 {
+				t.Error("QR not set")
+			}
+		})
+	}
+}
+
+func TestHandleQueryStripHTTPS(t *testing.T) {
+	tests := []struct {
+		name          string
+		strip         bool
+		qtype         uint16
+		wantForwarded bool
+	}{
+		{"https stripped", true, typeHTTPS, false},
+		{"a not stripped", true, typeA, true},
+		{"https disabled", false, typeHTTPS, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, forwarded := testProxy(t, Options{StripHTTPSRecords: tt.strip}, func(q []byte) []byte {
+				return emptyResponse(q, rcodeNoError)
+			})
+			res := handle(t, p, mkQuery(t, "example.com", tt.qtype, -1))
+			if got := len(*forwarded) > 0; got != tt.wantForwarded {
+				t.Fatalf("forwarded = %v, want %v", got, tt.wantForwarded)
+			}
+			if rcode(res) != rcodeNoError || count(res, 6) != 0 {
+				t.Errorf("rcode = %d, answers = %d, want NODATA", rcode(res), count(res, 6))
+			}
+			if !tt.wantForwarded && count(res, 8) != 1 {
+				t.Errorf("NSCOUNT = %d, want a SOA", count(res, 8))
+			}
+		})
+	}
+}
+
+type providerFunc func(ctx context.Context) ([]*endpoint.Endpoint, error)
+
+func (f providerFunc) GetEndpoints(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	return f(ctx)
+}
+
+// udpServer returns the address of a UDP server answering each packet with
+// the one returned by answer, and a function stopping it.
+func udpServer(t *testing.T, answer func(q []byte) []byte) (string, func()) {
+	t.Helper()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = c.WriteTo(answer(append([]byte(nil), buf[:n]...)), addr)
+		}
+	}()
+	return c.LocalAddr().String(), func() { c.Close() }
+}
+
+// udpEcho returns the address of a UDP server sending back each packet, which
+// makes the tests of plain DNS endpoints succeed, and a function stopping it.
+func udpEcho(t *testing.T) (string, func()) {
+	return udpServer(t, func(q []byte) []byte { return q })
+}
+
+func TestNetworkRecovery(t *testing.T) {
+	const active = "https://dns1.example.com#192.0.2.1"
+	addr, stop := udpEcho(t)
+	defer stop()
+	var mu sync.Mutex
+	online := false
+	var firsts []*endpoint.Endpoint
+	p := &Proxy{}
+	recovered := make(chan string, 1)
+	p.OnRecover = func(e string) { recovered <- e }
+	p.testManager = func(ctx context.Context, first *endpoint.Endpoint) *endpoint.Manager {
+		mu.Lock()
+		firsts = append(firsts, first)
+		mu.Unlock()
+		return &endpoint.Manager{
+			Providers: []endpoint.Provider{&upstreamProvider{proxy: p, provider: providerFunc(func(ctx context.Context) ([]*endpoint.Endpoint, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if !online {
+					return nil, errors.New("network unreachable")
+				}
+				return []*endpoint.Endpoint{{Protocol: endpoint.ProtocolDNS, Hostname: addr}}, nil
+			})}},
+			OnChange: func(e *endpoint.Endpoint) {
+				p.setActiveEndpoint(e.String())
+			},
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.replaceTransport(ctx, nil)
+	p.setActiveEndpoint(active)
+	initial := p.transport()
+
+	tests := []struct {
+		name          string
+		recovery      bool
+		online        bool
+		wantRecovered bool
+		wantManagers  int
+	}{
+		{"disabled", false, false, false, 1},
+		{"outage", true, false, false, 2},
+		{"restored", true, true, true, 3},
+	}
+	for _, tt := range tests {
+		if err := p.SetOptions(Options{NetworkRecovery: tt.recovery}); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		online = tt.online
+		mu.Unlock()
+		p.onNetworkChange(ctx)
+		select {
+		case e := <-recovered:
+			if !tt.wantRecovered {
+				t.Fatalf("%s: recovered on %s", tt.name, e)
+			}
+			if e != addr {
+				t.Errorf("%s: recovered on %s, want %s", tt.name, e, addr)
+			}
+			if p.transport() == initial {
+				t.Errorf("%s: transport not replaced", tt.name)
+			}
+		case <-time.After(500 * time.Millisecond):
+			// Not waiting for the backoff of the previous discovery shows
+			// the recovery is prompt.
+			if tt.wantRecovered {
+				t.Fatalf("%s: not recovered", tt.name)
+			}
+			if p.transport() != initial {
+				t.Errorf("%s: transport replaced before an endpoint was selected", tt.name)
+			}
+		}
+		mu.Lock()
+		if len(firsts) != tt.wantManagers {
+			t.Errorf("%s: %d transports created, want %d", tt.name, len(firsts), tt.wantManagers)
+		} else if last := firsts[len(firsts)-1]; tt.recovery && (last == nil || last.String() != active) {
+			t.Errorf("%s: discovery started with %v, want the active endpoint %s", tt.name, last, active)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestHandleQueryRotateAnswers(t *testing.T) {
+	tests := []struct {
+		name       string
+		rotate     bool
+		wantRotate bool
+	}{
+		{"enabled", true, true},
+		{"disabled", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := testProxy(t, Options{RotateAnswers: tt.rotate}, func(q []byte) []byte {
+				return answerA(q, "192.0.2.1", "192.0.2.2")
+			})
+			q := mkQuery(t, "example.com", typeA, -1)
+			first := answerData(t, handle(t, p, q))
+			second := answerData(t, handle(t, p, q))
+			if rotated := !bytes.Equal(first, second); rotated != tt.wantRotate {
+				t.Errorf("answers %v then %v, want rotated %v", first, second, tt.wantRotate)
+			}
+		})
+	}
+}
+
+func TestHandleQueryNegativeSOA(t *testing.T) {
+	soa := SOA{"ns.example.com.", "admin.example.com.", 120}
+	tests := []struct {
+		name  string
+		opts  Options
+		qtype uint16
+		want  int
+	}{
+		{"local domain", Options{LocalDomains: []string{"corp"}, SOA: soa}, typeA, rcodeNXDomain},
+		{"stripped https", Options{LocalDomains: []string{"corp"}, StripHTTPSRecords: true, SOA: soa}, typeHTTPS, rcodeNoError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, forwarded := testProxy(t, tt.opts, func(q []byte) []byte {
+				return emptyResponse(q, rcodeServFail)
+			})
+			res := handle(t, p, mkQuery(t, "host.corp", tt.qtype, -1))
+			if len(*forwarded) > 0 {
+				t.Fatal("query forwarded")
+			}
+			if rcode(res) != tt.want {
+				t.Errorf("rcode = %d, want %d", rcode(res), tt.want)
+			}
+			checkSOA(t, res, soa)
+		})
+	}
+	p := &Proxy{}
+	if err := p.CheckOptions(Options{SOA: SOA{MName: "a..b"}}); err == nil {
+		t.Error("invalid SOA name accepted")
+	}
+}
+
+func TestSetDeviceInfo(t *testing.T) {
+	tests := []struct {
+		name       string
+		deviceName string
+		want       http.Header
+	}{
+		{"reported", "My PC", http.Header{
+			"X-Device-Name":  {"My PC"},
+			"X-Device-Model": {"Laptop"},
+			"X-Device-Id":    {"abcd"},
+			"User-Agent":     {"nextdns-windows/1.0"},
+		}},
+		{"disabled", "", http.Header{
+			"User-Agent": {"nextdns-windows/1.0"},
+		}},
+	}
+	// The same proxy is used for all cases so disabling the report after
+	// enabling it is covered.
+	var got http.Header
+	p := &Proxy{
+		Upstream: "https://dns.example.com/abcdef",
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			got = req.Header
+			return upstreamFunc(func(q []byte) []byte {
+				return emptyResponse(q, rcodeNoError)
+			}).RoundTrip(req)
+		}),
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.deviceName != "" {
+				p.SetDeviceInfo(tt.deviceName, "Laptop", "abcd", "1.0")
+			} else {
+				p.SetDeviceInfo("", "", "", "1.0")
+			}
+			handle(t, p, mkQuery(t, "example.com", typeA, -1))
+			for name := range tt.want {
+				if got.Get(name) != tt.want.Get(name) {
+					t.Errorf("%s = %q, want %q", name, got.Get(name), tt.want.Get(name))
+				}
+			}
+			for _, name := range []string{"X-Device-Name", "X-Device-Model", "X-Device-Id"} {
+				if _, found := tt.want[name]; !found && got.Get(name) != "" {
+					t.Errorf("%s = %q, want none", name, got.Get(name))
+				}
+			}
+		})
+	}
+}
+
+func TestHandleQueryLocalDomains(t *testing.T) {
+	resolver, stop := udpServer(t, func(q []byte) []byte {
+		return answerA(q, "10.0.0.1")
+	})
+	defer stop()
+	tests := []struct {
+		name          string
+		qname         string
+		resolver      string
+		wantForwarded bool
+		wantRcode     int
+		wantAnswers   int
+	}{
+		{"nxdomain", "host.corp.example", "", false, rcodeNXDomain, 0},
+		{"domain itself", "corp.example", "", false, rcodeNXDomain, 0},
+		{"local resolver", "host.corp.example", resolver, false, rcodeNoError, 1},
+		{"other domain", "host.example", resolver, true, rcodeNoError, 1},
+		{"suffix only", "hostcorp.example", "", true, rcodeNoError, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{LocalDomains: []string{"corp.example"}, LocalResolver: tt.resolver}
+			p, forwarded := testProxy(t, opts, func(q []byte) []byte {
+				return answerA(q, "192.0.2.1")
+			})
+			res := handle(t, p, mkQuery(t, tt.qname, typeA, -1))
+			if got := len(*forwarded) > 0; got != tt.wantForwarded {
+				t.Fatalf("sent to NextDNS = %v, want %v", got, tt.wantForwarded)
+			}
+			if rcode(res) != tt.wantRcode || count(res, 6) != tt.wantAnswers {
+				t.Errorf("rcode = %d, answers = %d, want %d and %d", rcode(res), count(res, 6), tt.wantRcode, tt.wantAnswers)
+			}
+		})
+	}
+}
+
+func TestHandleQueryBlockedStat(t *testing.T) {
+	tests := []struct {
+		name        string
+		qtype       uint16
+		ips         []string
+		wantBlocked bool
+	}{
+		{"blocked A", typeA, []string{"0.0.0.0"}, true},
+		{"blocked AAAA", typeAAAA, []string{"::"}, true},
+		{"resolved", typeA, []string{"192.0.2.1"}, false},
+		{"partly unspecified", typeA, []string{"0.0.0.0", "192.0.2.1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			p, _ := testProxy(t, Options{}, func(q []byte) []byte {
+				return answerA(q, tt.ips...)
+			})
+			p.StatsD = &statsd.Client{}
+			p.StatsD.SetConfig(pc.LocalAddr().String(), "nextdns.", nil, 10*time.Millisecond)
+			defer p.StatsD.SetConfig("", "", nil, 0)
+
+			res := handle(t, p, mkQuery(t, "ads.example.com", tt.qtype, -1))
+			if got := isBlockedResponse(res); got != tt.wantBlocked {
+				t.Errorf("isBlockedResponse = %v, want %v", got, tt.wantBlocked)
+			}
+			// A flush can happen while the query is handled, so the
+			// metrics are read until no more are sent.
+			var metrics string
+			buf := make([]byte, 1500)
+			for timeout := time.Second; ; timeout = 100 * time.Millisecond {
+				_ = pc.SetReadDeadline(time.Now().Add(timeout))
+				n, _, err := pc.ReadFrom(buf)
+				if err != nil {
+					break
+				}
+				metrics += string(buf[:n]) + "\n"
+			}
+			if !strings.Contains(metrics, "nextdns.queries:1|c") {
+				t.Fatalf("metrics = %q, want the query counted", metrics)
+			}
+			if got := strings.Contains(metrics, "nextdns.blocked.server:1|c"); got != tt.wantBlocked {
+				t.Errorf("metrics = %q, blocked.server counted %v, want %v", metrics, got, tt.wantBlocked)
+			}
+		})
+	}
+}
+
+func TestHandleQueryMaxNegativeTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     time.Duration
+		wantTTL int
+	}{
+		{"default", 0, int(DefaultMaxNegativeTTL / time.Second)},
+		{"configured", 10 * time.Second, 10},
+		{"disabled", -1, 3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := testProxy(t, Options{MaxNegativeTTL: tt.max}, func(q []byte) []byte {
+				return negativeResponse(q, rcodeNXDomain, SOA{MinTTL: 3600})
+			})
+			res := handle(t, p, mkQuery(t, "example.com", typeA, -1))
+			_, ns, _, err := sections(res)
+			if err != nil || len(ns) != 1 {
+				t.Fatalf("sections: %v, %d authority records", err, len(ns))
+			}
+			min := res[ns[0].end-4:]
+			if got := count(min, 0)<<16 | count(min, 2); got != tt.wantTTL {
+				t.Errorf("negative TTL = %d, want %d", got, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestResetConnections(t *testing.T) {
+	tests := []struct {
+		name    string
+		started bool
+		hosts   []string
+		want    int
+		wantErr bool
+	}{
+		{"not started", false, nil, 0, true},
+		{"no connection", true, nil, 0, false},
+		{"one endpoint", true, []string{"example.com"}, 1, false},
+		{"two endpoints", true, []string{"example.com", "www.example.com"}, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, accepted := testServer(t)
+			defer srv.Close()
+			roots := x509.NewCertPool()
+			roots.AddCert(srv.Certificate())
+			p := &Proxy{}
+			p.pool.rootCAs = roots
+			get := func(host string) {
+				t.Helper()
+				req, _ := http.NewRequest("GET", "https://"+host+"/", nil)
+				res, err := p.pool.roundTrip(host, srv.Listener.Addr().String(), "", req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _ = ioutil.ReadAll(res.Body)
+				res.Body.Close()
+			}
+			if tt.started {
+				p.Transport = http.DefaultTransport
+			}
+			for _, host := range tt.hosts {
+				get(host)
+			}
+			n, err := p.ResetConnections()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if n != tt.want {
+				t.Errorf("reset = %d, want %d", n, tt.want)
+			}
+			if !tt.started {
+				return
+			}
+			if n := p.pool.openConns(); n != 0 {
+				t.Errorf("%d open connections after reset", n)
+			}
+			for _, host := range tt.hosts {
+				get(host)
+			}
+			if n := accepted(); n != 2*len(tt.hosts) {
+				t.Errorf("server accepted %d connections, want %d", n, 2*len(tt.hosts))
+			}
+		})
+	}
+}
+
+func TestHandleQueryEDNSVersion(t *testing.T) {
+	tests := []struct {
+		name          string
+		forward       bool
+		edns          int
+		wantForwarded bool
+	}{
+		{"no edns", false, -1, true},
+		{"edns0", false, 0, true},
+		{"edns1 answered", false, 1, false},
+		{"edns1 forwarded", true, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, forwarded := testProxy(t, Options{ForwardUnsupportedEDNS: tt.forward}, func(q []byte) []byte {
+				return answerA(q, "192.0.2.1")
+			})
+			res := handle(t, p, mkQuery(t, "example.com", typeA, tt.edns))
+			if got := len(*forwarded) > 0; got != tt.wantForwarded {
+				t.Fatalf("forwarded = %v, want %v", got, tt.wantForwarded)
+			}
+			if !tt.wantForwarded && count(res, 6) != 0 {
+				t.Errorf("BADVERS response has %d answers", count(res, 6))
+			}
+		})
+	}
+}
+
+func TestAcquireInflight(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxInflight int
+		acquire     int
+		want        int
+	}{
+		{"under limit", 4, 3, 3},
+		{"at limit", 4, 6, 4},
+		{"default", 0, DefaultMaxInflight + 2, DefaultMaxInflight},
+		{"negative uses default", -1, DefaultMaxInflight + 1, DefaultMaxInflight},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{}
+			if err := p.SetOptions(Options{MaxInflight: tt.maxInflight}); err != nil {
+				t.Fatal(err)
+			}
+			got := 0
+			for i := 0; i < tt.acquire; i++ {
+				if p.acquireInflight() {
+					got++
+				}
+			}
+			if got != tt.want {
+				t.Errorf("acquired %d slots, want %d", got, tt.want)
+			}
+			p.releaseInflight()
+			if !p.acquireInflight() {
+				t.Error("no slot acquired after a release")
+			}
+		})
+	}
+}
+
+func TestRestartDelay(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        Options
+		failures    int
+		want        time.Duration
+		wantBackoff bool
+	}{
+		{"first attempt", Options{}, 0, restartDelay, false},
+		{"under threshold", Options{}, DefaultStartBackoffThreshold - 1, restartDelay, false},
+		{"at threshold", Options{}, DefaultStartBackoffThreshold, 2 * restartDelay, true},
+		{"doubled", Options{}, DefaultStartBackoffThreshold + 2, 8 * restartDelay, true},
+		{"default max", Options{}, 100, DefaultStartBackoffMax, true},
+		{"custom threshold", Options{StartBackoffThreshold: 1}, 1, 2 * restartDelay, true},
+		{"custom max", Options{StartBackoffThreshold: 1, StartBackoffMax: 30 * time.Second}, 10, 30 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backoff := false
+			p := &Proxy{
+				OnStartBackoff: func(failures int, delay time.Duration) {
+					backoff = true
+					if failures != tt.failures || delay != tt.want {
+						t.Errorf("OnStartBackoff(%d, %v), want (%d, %v)", failures, delay, tt.failures, tt.want)
+					}
+				},
+			}
+			if err := p.SetOptions(tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			p.startFailures = tt.failures
+			if got := p.restartDelayLocked(); got != tt.want {
+				t.Errorf("restartDelayLocked = %v, want %v", got, tt.want)
+			}
+			if backoff != tt.wantBackoff {
+				t.Errorf("backoff reported = %v, want %v", backoff, tt.wantBackoff)
+			}
+		})
+	}
+}
+
+func TestStopWhileRestarting(t *testing.T) {
+	p := &Proxy{state: StateStarted}
+	done := make(chan struct{})
+	go func() {
+		p.restartOrStop()
+		close(done)
+	}()
+	for {
+		p.mu.Lock()
+		waiting := p.retryNow != nil
+		p.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("restart delay not interrupted by Stop")
+	}
+	if s := p.State(); s != StateStopped {
+		t.Errorf("state = %s, want %s", s, StateStopped)
+	}
+}
+
+func TestHandleQueryResponseFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		rd   bool
+	}{
+		{"recursion desired", true},
+		{"no recursion desired", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := testProxy(t, Options{}, func(q []byte) []byte {
+				res := answerA(q, "192.0.2.1")
+				res[2] |= 0x01  // RD regardless of the query
+				res[3] &^= 0x80 // no RA
+				return res
+			})
+			q := mkQuery(t, "example.com", typeA, -1)
+			if !tt.rd {
+				q[2] &^= 0x01
+			}
+			res := handle(t, p, q)
+			if rd := res[2]&0x01 != 0; rd != tt.rd {
+				t.Errorf("RD = %v, want %v", rd, tt.rd)
+			}
+			if res[3]&0x80 == 0 {
+				t.Error("RA not set")
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// privateNets lists the networks answers for public names are not expected to
+// point to: RFC 1918, loopback, link-local and unique local addresses.
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+		"127.0.0.0/8", "169.254.0.0/16",
+		"::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// privateAnswer returns the first A or AAAA answer of msg in privateNets, or
+// nil if there is none.
+func privateAnswer(msg []byte) net.IP {
+	an, _, _, err := sections(msg)
+	if err != nil {
+		return nil
+	}
+	for _, r := range an {
+		if (r.typ != typeA || r.end-r.rdOff != net.IPv4len) && (r.typ != typeAAAA || r.end-r.rdOff != net.IPv6len) {
+			continue
+		}
+		ip := net.IP(msg[r.rdOff:r.end])
+		for _, n := range privateNets {
+			if n.Contains(ip) {
+				return append(net.IP(nil), ip...)
+			}
+		}
+	}
+	return nil
+}
+
+// rebindingResponse returns an NXDOMAIN response replacing the upstream
+// response res if it points the public name qname to a private address, or
+// nil if it does not. Names in allowed or any of its subdomains, and private
+// names, are allowed to resolve to private addresses.
+func (p *Proxy) rebindingResponse(res []byte, qname string, allowed []string) []byte {
+	if isPrivateName(qname, allowed) {
+		return nil
+	}
+	ip := privateAnswer(res)
+	if ip == nil {
+		return nil
+	}
+	p.logInfo(fmt.Sprintf("DNS rebinding protection: %s resolved to %s, answering NXDOMAIN", qname, ip))
+	return negativeResponse(res, rcodeNXDomain, p.options().SOA)
+}
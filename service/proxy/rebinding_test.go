@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPrivateAnswer(t *testing.T) {
+	tests := []struct {
+		name  string
+		qtype uint16
+		ips   []string
+		want  string // "" for none
+	}{
+		{"public", typeA, []string{"93.184.216.34"}, ""},
+		{"rfc1918", typeA, []string{"93.184.216.34", "192.168.1.10"}, "192.168.1.10"},
+		{"loopback", typeA, []string{"127.0.0.1"}, "127.0.0.1"},
+		{"link-local", typeA, []string{"169.254.1.1"}, "169.254.1.1"},
+		{"unique local", typeAAAA, []string{"fd00::1"}, "fd00::1"},
+		{"public ipv6", typeAAAA, []string{"2606:2800:220:1::"}, ""},
+		{"no answer", typeA, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := staticResponse(mkQuery(t, "www.example.com", tt.qtype, -1), tt.qtype, tt.ips, SOA{})
+			got := privateAnswer(res)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("privateAnswer = %v, want none", got)
+				}
+				return
+			}
+			if !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("privateAnswer = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRebindingResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		qname   string
+		ip      string
+		allowed []string
+		wantNX  bool
+	}{
+		{"public address", "www.example.com", "93.184.216.34", nil, false},
+		{"private address", "www.example.com", "192.168.1.10", nil, true},
+		{"private name", "nas.lan", "192.168.1.10", nil, false},
+		{"allowed domain", "nas.example.com", "192.168.1.10", []string{"example.com"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{}
+			res := answerA(mkQuery(t, tt.qname, typeA, -1), tt.ip)
+			nx := p.rebindingResponse(res, tt.qname+".", tt.allowed)
+			if (nx != nil) != tt.wantNX {
+				t.Fatalf("rebindingResponse = %v, want NXDOMAIN %v", nx, tt.wantNX)
+			}
+			if nx != nil && (rcode(nx) != rcodeNXDomain || count(nx, 6) != 0) {
+				t.Errorf("rcode = %d with %d answers, want NXDOMAIN without answer", rcode(nx), count(nx, 6))
+			}
+		})
+	}
+}
+
+func TestHandleQueryRebinding(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       Options
+		wantRcode  int
+		wantAnswer bool
+	}{
+		{"disabled", Options{}, rcodeNoError, true},
+		{"enabled", Options{RebindingProtection: true}, rcodeNXDomain, false},
+		{"allowlist", Options{RebindingProtection: true, RebindingAllowlist: []string{"example.com"}}, rcodeNoError, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := testProxy(t, tt.opts, func(q []byte) []byte {
+				return answerA(q, "10.0.0.1")
+			})
+			res := handle(t, p, mkQuery(t, "nas.example.com", typeA, -1))
+			if rcode(res) != tt.wantRcode {
+				t.Errorf("rcode = %d, want %d", rcode(res), tt.wantRcode)
+			}
+			if got := count(res, 6) > 0; got != tt.wantAnswer {
+				t.Errorf("answered = %v, want %v", got, tt.wantAnswer)
+			}
+		})
+	}
+}
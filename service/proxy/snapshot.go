@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot holds the runtime state of a proxy, as captured by TakeSnapshot, to
+// reproduce it in another instance with RestoreSnapshot.
+type Snapshot struct {
+	State    string            `json:"state"`
+	Endpoint string            `json:"endpoint,omitempty"`
+	HotNames map[string]uint64 `json:"hotNames,omitempty"`
+	Stats    Stats             `json:"stats"`
+}
+
+// Stats are counters of the activity of a proxy. The queries, blocked and
+// errors counts are those since the last summary log, or since the proxy was
+// created if SummaryInterval is not set.
+type Stats struct {
+	Queries   uint64 `json:"queries"`
+	Blocked   uint64 `json:"blocked"`
+	Errors    uint64 `json:"errors"`
+	Inflight  int    `json:"inflight"`  // queries being handled
+	OpenConns int    `json:"openConns"` // upstream connections
+}
+
+// TakeSnapshot returns the current state of p.
+func (p *Proxy) TakeSnapshot() Snapshot {
+	queries, blocked, errors := p.activity.counts()
+	return Snapshot{
+		State:    p.State(),
+		Endpoint: p.ActiveEndpoint(),
+		HotNames: p.hotNames.counts(),
+		Stats: Stats{
+			Queries:   queries,
+			Blocked:   blocked,
+			Errors:    errors,
+			Inflight:  int(atomic.LoadInt32(&p.inflight)),
+			OpenConns: p.pool.openConns(),
+		},
+	}
+}
+
+// RestoreSnapshot restores the hot names counts of s and, if p is started,
+// switches to the endpoint of s, falling back on the regular discovery if it
+// fails. The state and stats of s are informative only: use Start or Stop to
+// change the state.
+func (p *Proxy) RestoreSnapshot(s Snapshot) error {
+	p.hotNames.restore(s.HotNames)
+	if s.Endpoint == "" || p.State() == StateStopped {
+		return nil
+	}
+	p.logInfo(fmt.Sprintf("Restoring endpoint %s", s.Endpoint))
+	return p.switchEndpoint(s.Endpoint)
+}
+
+// restore replaces the counts with counts, starting a new window.
+func (h *hotNames) restore(counts map[string]uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.current = map[string]uint64{}
+	h.previous = nil
+	h.windowStart = time.Now()
+	for n, c := range counts {
+		if len(h.current) >= maxHotNamesTracked {
+			break
+		}
+		h.current[n] = c
+	}
+}
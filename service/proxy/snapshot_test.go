@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestTakeSnapshotStats(t *testing.T) {
+	p, _ := testProxy(t, Options{}, func(q []byte) []byte {
+		if bytes.Contains(q, []byte("\x03ads")) {
+			return answerA(q, "0.0.0.0")
+		}
+		return answerA(q, "192.0.2.1")
+	})
+	handle(t, p, mkQuery(t, "www.example.com", typeA, -1))
+	handle(t, p, mkQuery(t, "ads.example.com", typeA, -1))
+	// Queries and errors are counted by the loop reading the tun interface.
+	p.activity.add(2, 0, 1)
+	want := Stats{Queries: 2, Blocked: 1, Errors: 1}
+	if got := p.TakeSnapshot().Stats; !reflect.DeepEqual(got, want) {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+
+	// The stats are informative only.
+	restored := &Proxy{}
+	if err := restored.RestoreSnapshot(p.TakeSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.TakeSnapshot().Stats; got != (Stats{}) {
+		t.Errorf("restored stats = %+v, want none", got)
+	}
+}
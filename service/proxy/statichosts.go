@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// staticHostsTTL is the TTL of the answers generated from Options StaticHosts.
+const staticHostsTTL = 300
+
+// normalizeStaticHosts validates hosts, returning a copy with lower case
+// hostnames without trailing dot.
+func normalizeStaticHosts(hosts map[string][]string) (map[string][]string, error) {
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+	norm := make(map[string][]string, len(hosts))
+	for host, ips := range hosts {
+		name := strings.ToLower(strings.TrimSuffix(host, "."))
+		if name == "" {
+			return nil, fmt.Errorf("invalid static host %q", host)
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("static host %s: no IP", host)
+		}
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("static host %s: invalid IP %q", host, ip)
+			}
+		}
+		norm[name] = ips
+	}
+	return norm, nil
+}
+
+// staticHost returns the IPs statically defined for name, if any.
+func (p *Proxy) staticHost(name string) []string {
+	hosts := p.options().StaticHosts
+	if len(hosts) == 0 {
+		return nil
+	}
+	return hosts[strings.ToLower(strings.TrimSuffix(name, "."))]
+}
+
+// staticResponse returns a response to q with the IPs of the family of qtype
+// as answers. If none matches, a NODATA response is returned.
+func staticResponse(q []byte, qtype uint16, ips []string, soa SOA) []byte {
+	res := emptyResponse(q, rcodeNoError)
+	if len(res) == dnsHeaderSize {
+		return res
+	}
+	var count int
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if (qtype == typeA) != (len(ip) == net.IPv4len) {
+			continue
+		}
+		res = append(res,
+			0xc0, dnsHeaderSize, // pointer to the question name
+			byte(qtype>>8), byte(qtype), 0, 1, // type, class IN
+			byte(staticHostsTTL>>24), byte(staticHostsTTL>>16), byte(staticHostsTTL>>8), byte(staticHostsTTL&0xff),
+			0, byte(len(ip)), // rdlength
+		)
+		res = append(res, ip...)
+		count++
+	}
+	if count == 0 {
+		return negativeResponse(q, rcodeNoError, soa)
+	}
+	res[6], res[7] = byte(count>>8), byte(count)
+	return res
+}
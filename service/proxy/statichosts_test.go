@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeStaticHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   map[string][]string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{"empty", nil, nil, false},
+		{"normalized", map[string][]string{"Router.NextDNS.io.": {"192.0.2.1", "2001:db8::1"}},
+			map[string][]string{"router.nextdns.io": {"192.0.2.1", "2001:db8::1"}}, false},
+		{"empty name", map[string][]string{".": {"192.0.2.1"}}, nil, true},
+		{"no ip", map[string][]string{"router.nextdns.io": nil}, nil, true},
+		{"invalid ip", map[string][]string{"router.nextdns.io": {"192.0.2"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeStaticHosts(tt.hosts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeStaticHosts error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalizeStaticHosts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaticResponse(t *testing.T) {
+	ips := []string{"192.0.2.1", "2001:db8::2", "192.0.2.3"}
+	tests := []struct {
+		name  string
+		qtype uint16
+		ips   []string
+		want  []byte // last byte of each answer
+	}{
+		{"a", typeA, ips, []byte{1, 3}},
+		{"aaaa", typeAAAA, ips, []byte{2}},
+		{"nodata", typeAAAA, []string{"192.0.2.1"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := staticResponse(mkQuery(t, "router.nextdns.io", tt.qtype, -1), tt.qtype, tt.ips, SOA{})
+			if rcode(res) != rcodeNoError {
+				t.Fatalf("rcode = %d, want NOERROR", rcode(res))
+			}
+			if got := answerData(t, res); !bytes.Equal(got, tt.want) {
+				t.Errorf("answers = %v, want %v", got, tt.want)
+			}
+			if len(tt.want) == 0 && count(res, 8) != 1 {
+				t.Errorf("NODATA response has %d authority records, want the SOA", count(res, 8))
+			}
+		})
+	}
+}
+
+func TestHandleQueryStaticHosts(t *testing.T) {
+	tests := []struct {
+		name          string
+		qname         string
+		qtype         uint16
+		authoritative bool
+		wantForwarded bool
+		wantAA        bool
+	}{
+		{"static", "router.nextdns.io", typeA, false, false, false},
+		{"case and trailing dot", "Router.NextDNS.io.", typeA, false, false, false},
+		{"authoritative", "router.nextdns.io", typeA, true, false, true},
+		{"other type forwarded", "router.nextdns.io", 16 /* TXT */, false, true, false},
+		{"other name forwarded", "example.com", typeA, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, forwarded := testProxy(t, Options{
+				StaticHosts:        map[string][]string{"router.nextdns.io": {"192.0.2.10"}},
+				AuthoritativeLocal: tt.authoritative,
+			}, func(q []byte) []byte {
+				return emptyResponse(q, rcodeNoError)
+			})
+			res := handle(t, p, mkQuery(t, tt.qname, tt.qtype, -1))
+			if got := len(*forwarded) > 0; got != tt.wantForwarded {
+				t.Fatalf("forwarded = %v, want %v", got, tt.wantForwarded)
+			}
+			if tt.wantForwarded {
+				return
+			}
+			if got := answerData(t, res); !bytes.Equal(got, []byte{10}) {
+				t.Errorf("answers = %v, want the static IP", got)
+			}
+			if got := res[2]&0x04 != 0; got != tt.wantAA {
+				t.Errorf("AA = %v, want %v", got, tt.wantAA)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// activity counts the queries handled since the last summary.
+type activity struct {
+	mu      sync.Mutex
+	queries uint64
+	blocked uint64
+	errors  uint64
+}
+
+func (a *activity) add(queries, blocked, errors uint64) {
+	a.mu.Lock()
+	a.queries += queries
+	a.blocked += blocked
+	a.errors += errors
+	a.mu.Unlock()
+}
+
+// counts returns the counts.
+func (a *activity) counts() (queries, blocked, errors uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.queries, a.blocked, a.errors
+}
+
+// reset returns the counts and sets them back to zero.
+func (a *activity) reset() (queries, blocked, errors uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	queries, blocked, errors = a.queries, a.blocked, a.errors
+	a.queries, a.blocked, a.errors = 0, 0, 0
+	return queries, blocked, errors
+}
+
+// logSummary logs a summary of the activity every SummaryInterval until ctx is
+// done.
+func (p *Proxy) logSummary(ctx context.Context) {
+	p.activity.reset()
+	t := time.NewTicker(p.SummaryInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		queries, blocked, errors := p.activity.reset()
+		endpoint := p.ActiveEndpoint()
+		if endpoint == "" {
+			endpoint = "none"
+		}
+		p.logInfo(fmt.Sprintf("Summary for the last %v: %d queries, %d blocked, %d errors, endpoint %s",
+			p.SummaryInterval, queries, blocked, errors, endpoint))
+	}
+}
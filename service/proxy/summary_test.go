@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActivity(t *testing.T) {
+	var a activity
+	a.add(1, 0, 0)
+	a.add(1, 1, 0)
+	a.add(1, 0, 1)
+	tests := []struct {
+		name                     string
+		queries, blocked, errors uint64
+	}{
+		{"counted", 3, 1, 1},
+		{"reset", 0, 0, 0},
+	}
+	for _, tt := range tests {
+		queries, blocked, errors := a.reset()
+		if queries != tt.queries || blocked != tt.blocked || errors != tt.errors {
+			t.Errorf("%s: reset = %d, %d, %d, want %d, %d, %d", tt.name, queries, blocked, errors, tt.queries, tt.blocked, tt.errors)
+		}
+	}
+}
+
+func TestLogSummary(t *testing.T) {
+	logs := make(chan string, 10)
+	p := &Proxy{
+		SummaryInterval: 20 * time.Millisecond,
+		InfoLog:         func(msg string) { logs <- msg },
+	}
+	p.activity.add(5, 5, 5) // before the start, not reported
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.logSummary(ctx)
+	next := func() string {
+		t.Helper()
+		select {
+		case msg := <-logs:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("no summary logged")
+			return ""
+		}
+	}
+	tests := []struct {
+		name string
+		add  func()
+		want string
+	}{
+		{"nothing", func() {}, "20ms: 0 queries, 0 blocked, 0 errors, endpoint none"},
+		{"activity", func() { p.activity.add(2, 1, 0) }, "20ms: 2 queries, 1 blocked, 0 errors, endpoint none"},
+	}
+	// Each summary covers the activity since the previous one.
+	for _, tt := range tests {
+		tt.add()
+		if msg := next(); !strings.HasSuffix(msg, tt.want) {
+			t.Errorf("%s: summary %q, want it to end with %q", tt.name, msg, tt.want)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//+build !windows
+
+package proxy
+
+import (
+	"strings"
+	"syscall"
+)
+
+// setTOS sets the ToS byte, or the traffic class for IPv6, of the socket fd
+// dialed on network.
+func setTOS(fd uintptr, network string, tos int) error {
+	if strings.HasSuffix(network, "6") {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+}
@@ -0,0 +1,61 @@
+//+build !windows
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestConnPoolDSCP(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		addr    string
+		dscp    int
+		wantTOS int
+	}{
+		{"unmarked", "tcp4", "127.0.0.1:0", 0, 0},
+		{"expedited forwarding", "tcp4", "127.0.0.1:0", 46, 184},
+		{"class selector 1", "tcp4", "127.0.0.1:0", 8, 32},
+		{"ipv6", "tcp6", "[::1]:0", 46, 184},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen(tt.network, tt.addr)
+			if err != nil {
+				t.Skipf("%s not available: %v", tt.network, err)
+			}
+			defer l.Close()
+			cp := &connPool{}
+			cp.setDSCP(tt.dscp)
+			d := &net.Dialer{Control: cp.control}
+			c, err := d.Dial(tt.network, l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			rc, err := c.(*net.TCPConn).SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+			if tt.network == "tcp6" {
+				level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+			}
+			var tos int
+			if cerr := rc.Control(func(fd uintptr) {
+				tos, err = syscall.GetsockoptInt(int(fd), level, opt)
+			}); cerr != nil {
+				t.Fatal(cerr)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tos != tt.wantTOS {
+				t.Errorf("ToS = %d, want %d", tos, tt.wantTOS)
+			}
+		})
+	}
+}
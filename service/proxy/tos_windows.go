@@ -0,0 +1,18 @@
+package proxy
+
+import (
+	"strings"
+	"syscall"
+)
+
+// ipv6TClass is the IPV6_TCLASS socket option, missing from syscall.
+const ipv6TClass = 39
+
+// setTOS sets the ToS byte, or the traffic class for IPv6, of the socket fd
+// dialed on network.
+func setTOS(fd uintptr, network string, tos int) error {
+	if strings.HasSuffix(network, "6") {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, ipv6TClass, tos)
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+}
@@ -0,0 +1,38 @@
+package proxy
+
+// Trace events reported to Proxy TraceLog with the detail they carry.
+const (
+	TraceReceive  = "receive"  // name of the query
+	TraceLocal    = "local"    // reason the query is answered locally
+	TraceForward  = "forward"  // address of the local resolver
+	TraceUpstream = "upstream" // endpoint the query is sent to
+	TraceBlocked  = "blocked"  // name of the query
+	TraceResponse = "response" // rcode of the response
+)
+
+// rcodeNames maps the rcodes of DNS headers to their mnemonic.
+var rcodeNames = [16]string{"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED", "YXDOMAIN", "YXRRSET", "NXRRSET", "NOTAUTH", "NOTZONE", "RCODE11", "RCODE12", "RCODE13", "RCODE14", "RCODE15"}
+
+// rcodeName returns the mnemonic of the rcode of msg.
+func rcodeName(msg []byte) string {
+	if len(msg) < dnsHeaderSize {
+		return "INVALID"
+	}
+	return rcodeNames[msg[3]&0xf]
+}
+
+// trace reports event to TraceLog. The details are passed as is so nothing is
+// formatted unless the callback decides to log the event.
+func (p *Proxy) trace(traceID uint32, msgID uint16, event, detail string) {
+	if p.TraceLog != nil {
+		p.TraceLog(traceID, msgID, event, detail)
+	}
+}
+
+// answer traces the locally generated response res with reason and writes it
+// in place of the query packet buf, returning the size of the response packet.
+func (p *Proxy) answer(traceID uint32, msgID uint16, buf, res []byte, reason string) int {
+	p.trace(traceID, msgID, TraceLocal, reason)
+	p.trace(traceID, msgID, TraceResponse, rcodeName(res))
+	return responsePacket(buf, copy(buf[28:cap(buf)], res))
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		answer   string
+		want     []string
+		wantLast string // detail of the last event
+	}{
+		{"upstream", Options{}, "192.0.2.1",
+			[]string{TraceReceive, TraceUpstream, TraceResponse}, "NOERROR"},
+		{"blocked", Options{}, "0.0.0.0",
+			[]string{TraceReceive, TraceUpstream, TraceBlocked, TraceResponse}, "NOERROR"},
+		{"local", Options{LocalDomains: []string{"example.com"}}, "",
+			[]string{TraceReceive, TraceLocal, TraceResponse}, "NXDOMAIN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := testProxy(t, tt.opts, func(q []byte) []byte {
+				return answerA(q, tt.answer)
+			})
+			var events, details []string
+			p.TraceLog = func(traceID uint32, msgID uint16, event, detail string) {
+				if traceID != 42 {
+					t.Errorf("event %s has trace ID %d, want 42", event, traceID)
+				}
+				events = append(events, event)
+				details = append(details, detail)
+			}
+			buf := make([]byte, 0, 1500)
+			buf = append(buf, queryPacket(mkQuery(t, "example.com", typeA, -1))...)
+			if _, err := p.handleQuery(context.Background(), 42, lazyMsgID(buf), buf); err != nil {
+				t.Fatalf("handleQuery: %v", err)
+			}
+			if !reflect.DeepEqual(events, tt.want) {
+				t.Fatalf("events = %v, want %v", events, tt.want)
+			}
+			if details[0] != "example.com." {
+				t.Errorf("receive detail = %q, want the query name", details[0])
+			}
+			if last := details[len(details)-1]; last != tt.wantLast {
+				t.Errorf("response detail = %q, want %q", last, tt.wantLast)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+)
+
+// The endpoint package does not expose the transports of its endpoints, so
+// their connections cannot be closed and stay open until the server closes
+// them. Requests are instead sent using the transports of a connPool owned by
+// the proxy. The endpoint package transports are only used to test endpoints,
+// a single connection each, and endpoints are shared by all the transports of
+// the proxy so they are not multiplied by transport replacements.
+
+// connPool holds the transports used to contact upstream servers, one per
+// server address, so their connections can be reset.
+type connPool struct {
+	// rootCAs is the set of root certificate authorities used to verify the
+	// servers. If nil, the system roots are used.
+	rootCAs *x509.CertPool
+
+	mu         sync.Mutex
+	transports map[string]*poolTransport // by hostname and address
+
+	conns int32 // open connections
+	dscp  int32 // marking of new connections
+}
+
+// poolTransport is a transport of connPool which tracks its connections and
+// in-flight requests so its connections can be closed once the requests
+// complete after a reset.
+type poolTransport struct {
+	*http.Transport
+
+	mu       sync.Mutex
+	conns    map[*poolConn]struct{}
+	inflight int
+	retired  bool // removed from the pool, close connections when unused
+}
+
+func (t *poolTransport) done() {
+	t.mu.Lock()
+	t.inflight--
+	unused := t.retired && t.inflight == 0
+	t.mu.Unlock()
+	if unused {
+		t.closeConns()
+	}
+}
+
+// retire closes the connections of t right away if it has no in-flight
+// requests, or once they complete otherwise.
+func (t *poolTransport) retire() {
+	t.mu.Lock()
+	t.retired = true
+	unused := t.inflight == 0
+	t.mu.Unlock()
+	if unused {
+		t.closeConns()
+	}
+}
+
+// closeConns closes the connections of t, which must have no in-flight
+// requests. They are closed directly as the transport puts connections back
+// in its idle pool asynchronously, possibly after CloseIdleConnections would
+// have been called.
+func (t *poolTransport) closeConns() {
+	t.mu.Lock()
+	conns := make([]*poolConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// poolConn is a connection of a poolTransport.
+type poolConn struct {
+	net.Conn
+	pool *connPool
+	t    *poolTransport
+	once sync.Once
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(func() {
+		c.t.mu.Lock()
+		delete(c.t.conns, c)
+		c.t.mu.Unlock()
+		atomic.AddInt32(&c.pool.conns, -1)
+	})
+	return c.Conn.Close()
+}
+
+// transport returns the transport of the server hostname reached at addr, and
+// registers a request on it. The caller must call done once the request
+// completes.
+func (cp *connPool) transport(hostname, addr string) *poolTransport {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	key := hostname + "|" + addr
+	t := cp.transports[key]
+	if t == nil {
+		t = cp.newTransport(hostname)
+		if cp.transports == nil {
+			cp.transports = map[string]*poolTransport{}
+		}
+		cp.transports[key] = t
+	}
+	t.mu.Lock()
+	t.inflight++
+	t.mu.Unlock()
+	return t
+}
+
+func (cp *connPool) newTransport(hostname string) *poolTransport {
+	t := &poolTransport{conns: map[*poolConn]struct{}{}}
+	d := &net.Dialer{Control: cp.control}
+	t.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{
+			ServerName: hostname,
+			RootCAs:    cp.rootCAs,
+		},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			nc, err := d.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			c := &poolConn{Conn: nc, pool: cp, t: t}
+			t.mu.Lock()
+			t.conns[c] = struct{}{}
+			t.mu.Unlock()
+			atomic.AddInt32(&cp.conns, 1)
+			return c, nil
+		},
+	}
+	return t
+}
+
+// setDSCP sets the DSCP value new connections are marked with and returns
+// true if it changed.
+func (cp *connPool) setDSCP(dscp int) bool {
+	return atomic.SwapInt32(&cp.dscp, int32(dscp)) != int32(dscp)
+}
+
+// control marks the connections dialed by the pool with its DSCP value, if
+// any. It is used as net.Dialer Control.
+func (cp *connPool) control(network, address string, c syscall.RawConn) error {
+	dscp := int(atomic.LoadInt32(&cp.dscp))
+	if dscp == 0 {
+		return nil
+	}
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		// The DSCP value is the 6 high bits of the former ToS byte.
+		err = setTOS(fd, network, dscp<<2)
+	}); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return fmt.Errorf("DSCP marking: %v", err)
+	}
+	return nil
+}
+
+// roundTrip sends req to the server hostname reached at addr, replacing its
+// path by path if not empty.
+func (cp *connPool) roundTrip(hostname, addr, path string, req *http.Request) (*http.Response, error) {
+	req.URL.Host = addr
+	req.Host = hostname
+	if path != "" {
+		req.URL.Path = path
+	}
+	t := cp.transport(hostname, addr)
+	res, err := t.RoundTrip(req)
+	if err != nil {
+		t.done()
+		return nil, err
+	}
+	res.Body = &doneBody{ReadCloser: res.Body, done: t.done}
+	return res, nil
+}
+
+// doneBody calls done once the body is closed.
+type doneBody struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (b *doneBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// endpoint returns a http.RoundTripper sending requests to the DoH endpoint e
+// with the transports of the pool. Other endpoints use their own transport.
+func (cp *connPool) endpoint(e *endpoint.Endpoint) http.RoundTripper {
+	if e.Protocol != endpoint.ProtocolDOH {
+		return e
+	}
+	addr := e.Hostname
+	if e.Bootstrap != "" {
+		addr = net.JoinHostPort(e.Bootstrap, "443")
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return cp.roundTrip(e.Hostname, addr, e.Path, req)
+	})
+}
+
+// reset closes the connections of the pool: idle ones right away and the
+// others once their in-flight request completes. New requests use new
+// connections. The number of open connections reset is returned.
+func (cp *connPool) reset() int {
+	cp.mu.Lock()
+	transports := cp.transports
+	cp.transports = nil
+	n := int(atomic.LoadInt32(&cp.conns))
+	cp.mu.Unlock()
+	for _, t := range transports {
+		t.retire()
+	}
+	return n
+}
+
+// openConns returns the number of open connections of the pool.
+func (cp *connPool) openConns() int {
+	return int(atomic.LoadInt32(&cp.conns))
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// upstreamTransport sends DoH requests to the endpoint selected by manager
+// using the transports of pool.
+type upstreamTransport struct {
+	manager *endpoint.Manager
+	pool    *connPool
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *upstreamTransport) RoundTrip(req *http.Request) (res *http.Response, err error) {
+	doErr := t.manager.Do(req.Context(), func(e *endpoint.Endpoint) error {
+		res, err = t.pool.endpoint(e).RoundTrip(req)
+		return err
+	})
+	if doErr != nil {
+		return nil, doErr
+	}
+	return res, err
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testServer returns a TLS server valid for example.com with the number of
+// connections it accepted.
+func testServer(t *testing.T) (*httptest.Server, func() int) {
+	t.Helper()
+	var mu sync.Mutex
+	accepted := 0
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	srv.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			mu.Lock()
+			accepted++
+			mu.Unlock()
+		}
+	}
+	srv.StartTLS()
+	return srv, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return accepted
+	}
+}
+
+func TestConnPoolReset(t *testing.T) {
+	tests := []struct {
+		name     string
+		inflight bool
+	}{
+		{"idle", false},
+		{"in-flight", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, accepted := testServer(t)
+			defer srv.Close()
+			roots := x509.NewCertPool()
+			roots.AddCert(srv.Certificate())
+			cp := &connPool{rootCAs: roots}
+			get := func() *http.Response {
+				t.Helper()
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				res, err := cp.roundTrip("example.com", srv.Listener.Addr().String(), "", req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return res
+			}
+			done := func(res *http.Response) {
+				_, _ = ioutil.ReadAll(res.Body)
+				res.Body.Close()
+			}
+
+			res := get()
+			if !tt.inflight {
+				done(res)
+			}
+			if n := cp.reset(); n != 1 {
+				t.Errorf("reset = %d, want 1", n)
+			}
+			want := 0
+			if tt.inflight {
+				want = 1
+			}
+			if n := cp.openConns(); n != want {
+				t.Errorf("%d open connections after reset, want %d", n, want)
+			}
+			if tt.inflight {
+				done(res)
+				if n := cp.openConns(); n != 0 {
+					t.Errorf("%d open connections after the in-flight request, want 0", n)
+				}
+			}
+
+			done(get())
+			if n := accepted(); n != 2 {
+				t.Errorf("server accepted %d connections, want 2 to reconnect after reset", n)
+			}
+			if n := cp.openConns(); n != 1 {
+				t.Errorf("%d open connections, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+)
+
+// Results returned by ValidateConfigID.
+const (
+	ConfigValid        = "valid"
+	ConfigInvalid      = "invalid"
+	ConfigNetworkError = "network-error"
+)
+
+// validateTimeout bounds the time spent validating a configuration ID.
+const validateTimeout = 5 * time.Second
+
+// ValidateConfigID sends a test query to NextDNS for configuration id and
+// returns ConfigValid if it is accepted, ConfigInvalid if it is rejected or
+// ConfigNetworkError if NextDNS could not be reached, along with the error in
+// the last two cases. The active configuration is not changed.
+func (p *Proxy) ValidateConfigID(ctx context.Context, id string) (string, error) {
+	return ValidateConfigID(ctx, p.transport(), id)
+}
+
+// ValidateConfigID is like Proxy.ValidateConfigID but uses rt to send the
+// query. If rt is nil, the NextDNS anycast endpoint is used.
+func ValidateConfigID(ctx context.Context, rt http.RoundTripper, id string) (string, error) {
+	if id == "" {
+		return ConfigInvalid, fmt.Errorf("empty configuration ID")
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return ConfigInvalid, fmt.Errorf("invalid character %q in configuration ID", c)
+		}
+	}
+	if rt == nil {
+		rt = endpoint.MustNew("https://dns1.nextdns.io#45.90.28.0")
+	}
+	ctx, cancel := context.WithTimeout(ctx, validateTimeout)
+	defer cancel()
+	q, err := testQuery(endpoint.TestDomain)
+	if err != nil {
+		return ConfigNetworkError, err
+	}
+	req, err := http.NewRequest("POST", "https://dns.nextdns.io/"+id, bytes.NewReader(q))
+	if err != nil {
+		return ConfigInvalid, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		return ConfigNetworkError, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		return ConfigInvalid, fmt.Errorf("error code: %d", res.StatusCode)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	if err != nil {
+		return ConfigNetworkError, err
+	}
+	if len(b) < dnsHeaderSize || b[0] != q[0] || b[1] != q[1] {
+		return ConfigInvalid, errInvalidMessage
+	}
+	return ConfigValid, nil
+}
+
+// testQuery returns a DNS query message for the A record of name.
+func testQuery(name string) ([]byte, error) {
+	q := []byte{
+		0x4e, 0x44, // ID
+		0x01, 0x00, // RD
+		0, 1, 0, 0, 0, 0, 0, 0, // QDCOUNT=1
+	}
+	q, err := appendName(q, name)
+	if err != nil {
+		return nil, err
+	}
+	return append(q, 0, typeA, 0, 1), nil // class IN
+}
@@ -0,0 +1,132 @@
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// ReadFile reads a JSON file holding an object with the same keys as the
+// settings map received from the GUI. The whole file is validated: unknown
+// keys and values of the wrong type are reported as errors instead of being
+// ignored like FromMap does. The errors do not quote the values of the file,
+// which can hold secrets such as the configuration ID.
+func ReadFile(path string) (map[string]interface{}, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no settings file")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		// The JSON errors can quote the file content.
+		if err, ok := err.(*json.SyntaxError); ok {
+			return nil, fmt.Errorf("%s: invalid JSON at offset %d", path, err.Offset)
+		}
+		return nil, fmt.Errorf("%s: not a JSON object", path)
+	}
+	if err := Validate(m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// ReadFeatures reads the feature toggles written by WriteFeatures to path. No
+// toggle is returned if the file does not exist.
+func ReadFeatures(path string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var f map[string]interface{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := CheckFeatures(f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return f, nil
+}
+
+// WriteFeatures writes the feature toggles f to path so they persist across
+// restarts.
+func WriteFeatures(path string, f map[string]interface{}) error {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// Validate returns an error if m has a key unknown to FromMap or a value of
+// an unexpected type.
+func Validate(m map[string]interface{}) error {
+	defaults := Settings{}.ToMap()
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		def, found := defaults[k]
+		if !found {
+			return fmt.Errorf("unknown setting %q", k)
+		}
+		if !validType(def, m[k]) {
+			return fmt.Errorf("invalid value type for %s", k)
+		}
+	}
+	return nil
+}
+
+// validType returns true if the JSON value v can be decoded by FromMap into a
+// field which ToMap value is def.
+func validType(def, v interface{}) bool {
+	switch def.(type) {
+	case bool:
+		_, ok := v.(bool)
+		return ok
+	case string:
+		_, ok := v.(string)
+		return ok
+	case float64:
+		_, ok := v.(float64)
+		return ok
+	case []string:
+		l, ok := v.([]interface{})
+		return ok && allStrings(l)
+	case map[string][]string:
+		hosts, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for _, ips := range hosts {
+			switch ips := ips.(type) {
+			case string:
+			case []interface{}:
+				if !allStrings(ips) {
+					return false
+				}
+			default:
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func allStrings(l []interface{}) bool {
+	for _, s := range l {
+		if _, ok := s.(string); !ok {
+			return false
+		}
+	}
+	return true
+}
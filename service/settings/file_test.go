@@ -0,0 +1,106 @@
+package settings
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       map[string]interface{}
+		wantErr bool
+	}{
+		{"empty", map[string]interface{}{}, false},
+		{"valid", map[string]interface{}{
+			"enabled":       true,
+			"configuration": "abcdef",
+			"idleTimeout":   60.0,
+			"localDomains":  []interface{}{"lan"},
+			"staticHosts":   map[string]interface{}{"router.nextdns.io": []interface{}{"192.0.2.1"}, "dns.lan": "192.0.2.53"},
+		}, false},
+		{"unknown key", map[string]interface{}{"rotateAnswer": true}, true},
+		{"wrong type", map[string]interface{}{"enabled": "yes"}, true},
+		{"wrong list type", map[string]interface{}{"localDomains": []interface{}{1.0}}, true},
+		{"wrong static hosts type", map[string]interface{}{"staticHosts": map[string]interface{}{"dns.lan": 1.0}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(tt.m); (err != nil) != tt.wantErr {
+				t.Errorf("Validate = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		content string // no file if empty
+		wantErr bool
+	}{
+		{"valid", `{"enabled": true, "configuration": "abcdef"}`, false},
+		{"invalid json", `{"enabled": true,`, true},
+		{"invalid setting", `{"enabled": true, "configuration": 1}`, true},
+		{"not an object", `["enabled"]`, true},
+		{"missing", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".json")
+			if tt.content != "" {
+				if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			m, err := ReadFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadFile = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && m["configuration"] != "abcdef" {
+				t.Errorf("ReadFile = %v", m)
+			}
+		})
+	}
+	if _, err := ReadFile(""); err == nil {
+		t.Error("ReadFile with no path succeeded")
+	}
+}
+
+func TestFeaturesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "features.json")
+
+	if f, err := ReadFeatures(path); err != nil || f != nil {
+		t.Errorf("ReadFeatures without file = %v, %v, want no toggle", f, err)
+	}
+	want := map[string]interface{}{"rotateAnswers": true, "trackHotNames": false}
+	if err := WriteFeatures(path, want); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ReadFeatures(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("ReadFeatures = %v, want %v", f, want)
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"dnssec": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFeatures(path); err == nil {
+		t.Error("ReadFeatures accepted an unknown feature")
+	}
+}
@@ -1,15 +1,139 @@
 package settings
 
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"time"
+)
+
 type Settings struct {
 	Enabled          bool
 	Configuration    string
 	ReportDeviceName bool
 	CheckUpdates     bool
 	UpdateChannel    string
+
+	// DeviceName is the name reported to NextDNS when ReportDeviceName is
+	// set, so queries from this machine are attributed to it in the NextDNS
+	// dashboard. If empty, the hostname is used. Reporting a name links all
+	// the queries of the machine together in the NextDNS logs.
+	DeviceName string
+
+	// StripHTTPSRecords answers HTTPS queries with no records, to
+	// troubleshoot ECH related connectivity issues.
+	StripHTTPSRecords bool
+
+	// RotateAnswers rotates the order of A and AAAA records on each response.
+	RotateAnswers bool
+
+	// MirrorUpstream is an optional DoH URL receiving a copy of all queries.
+	MirrorUpstream string
+
+	// LocalDomains are resolved locally instead of being sent to NextDNS,
+	// using LocalResolver if set or answering NXDOMAIN otherwise.
+	LocalDomains  []string
+	LocalResolver string
+
+	// StaticHosts maps hostnames to IPs used to contact the upstream servers
+	// with no DNS lookup and to answer queries for those hostnames.
+	StaticHosts map[string][]string
+
+	// RebindingProtection answers NXDOMAIN when a public name resolves to a
+	// private IP, except for names in RebindingAllowlist.
+	RebindingProtection bool
+	RebindingAllowlist  []string
+
+	// AuthoritativeLocal flags the answers for static hosts and local domains
+	// as authoritative, for DNS servers forwarding those zones to the proxy.
+	AuthoritativeLocal bool
+
+	// TrackHotNames counts queried names so the most queried ones can be
+	// exported with the export-hotnames command.
+	TrackHotNames bool
+
+	// RouterRefreshInterval is the interval at which the list of endpoints is
+	// refreshed from the NextDNS router. If zero, the proxy default is used.
+	RouterRefreshInterval time.Duration
+
+	// RaceBootstrap makes the proxy use the fastest router bootstrap IP
+	// instead of a random one.
+	RaceBootstrap bool
+
+	// StartupBehavior defines how queries received before the upstream is
+	// ready are handled (delay-until-ready, servfail or passthrough) and
+	// StartupTimeout how long they are delayed at most. If empty or zero, the
+	// proxy defaults are used.
+	StartupBehavior string
+	StartupTimeout  time.Duration
+
+	// NetworkRecovery makes the proxy re-run the endpoint discovery as soon
+	// as the network configuration changes. It is enabled by default.
+	NetworkRecovery bool
+
+	// SOAMName, SOARName and SOAMinTTL define the SOA record of locally
+	// generated negative responses, SOAMinTTL being the negative caching TTL
+	// in seconds. If empty or zero, the proxy defaults are used.
+	SOAMName  string
+	SOARName  string
+	SOAMinTTL uint32
+
+	// MaxNegativeTTL caps the negative caching TTL of NXDOMAIN and NODATA
+	// responses. If zero, the proxy default is used. A negative value
+	// disables it.
+	MaxNegativeTTL time.Duration
+
+	// PreferredRetryInterval is the initial interval at which the endpoint
+	// discovery is retried after falling back on an endpoint not provided by
+	// the NextDNS router, doubling up to PreferredRetryMaxInterval. If zero,
+	// the proxy defaults are used.
+	PreferredRetryInterval    time.Duration
+	PreferredRetryMaxInterval time.Duration
+
+	// IdleTimeout is the duration without queries after which the upstream
+	// connections are closed. If zero, the proxy default is used. A negative
+	// value disables it.
+	IdleTimeout time.Duration
+
+	// ForwardUnsupportedEDNS forwards queries with an EDNS version higher
+	// than 0 to NextDNS instead of answering them with BADVERS.
+	ForwardUnsupportedEDNS bool
+
+	// MaxInflight caps the number of queries handled concurrently. If zero,
+	// the proxy default is used.
+	MaxInflight int
+
+	// StartBackoffThreshold is the number of consecutive failed restart
+	// attempts after which the delay between attempts grows up to
+	// StartBackoffMax. If zero, the proxy defaults are used.
+	StartBackoffThreshold int
+	StartBackoffMax       time.Duration
+
+	// DSCP is the DSCP value, from 0 to 63, the upstream connections are
+	// marked with for QoS. Zero disables the marking.
+	DSCP int
+
+	// StatsD export of the proxy metrics, disabled when StatsDAddr is empty.
+	StatsDAddr          string
+	StatsDPrefix        string
+	StatsDTags          []string
+	StatsDFlushInterval time.Duration
 }
 
+// Source values reported by Effective.
+const (
+	SourceDefault  = "default"
+	SourceGUI      = "gui"
+	SourceFile     = "file"
+	SourceSnapshot = "snapshot"
+	SourceFeatures = "features" // toggled with the features ctl command
+)
+
 func FromMap(m map[string]interface{}) Settings {
-	var s Settings
+	s := Settings{
+		NetworkRecovery: true,
+	}
 	if v, ok := m["enabled"].(bool); ok {
 		s.Enabled = v
 	}
@@ -19,11 +143,276 @@ func FromMap(m map[string]interface{}) Settings {
 	if v, ok := m["reportDeviceName"].(bool); ok {
 		s.ReportDeviceName = v
 	}
+	if v, ok := m["deviceName"].(string); ok {
+		s.DeviceName = v
+	}
 	if v, ok := m["checkUpdates"].(bool); ok {
 		s.CheckUpdates = v
 	}
 	if v, ok := m["updateChannel"].(string); ok {
 		s.UpdateChannel = v
 	}
+	if v, ok := m["stripHTTPSRecords"].(bool); ok {
+		s.StripHTTPSRecords = v
+	}
+	if v, ok := m["rotateAnswers"].(bool); ok {
+		s.RotateAnswers = v
+	}
+	if v, ok := m["mirrorUpstream"].(string); ok {
+		s.MirrorUpstream = v
+	}
+	if v, ok := m["localDomains"].([]interface{}); ok {
+		s.LocalDomains = stringSlice(v)
+	}
+	if v, ok := m["localResolver"].(string); ok {
+		s.LocalResolver = v
+	}
+	if v, ok := m["staticHosts"].(map[string]interface{}); ok {
+		s.StaticHosts = map[string][]string{}
+		for host, ips := range v {
+			switch ips := ips.(type) {
+			case string:
+				s.StaticHosts[host] = []string{ips}
+			case []interface{}:
+				s.StaticHosts[host] = stringSlice(ips)
+			}
+		}
+	}
+	if v, ok := m["rebindingProtection"].(bool); ok {
+		s.RebindingProtection = v
+	}
+	if v, ok := m["rebindingAllowlist"].([]interface{}); ok {
+		s.RebindingAllowlist = stringSlice(v)
+	}
+	if v, ok := m["authoritativeLocal"].(bool); ok {
+		s.AuthoritativeLocal = v
+	}
+	if v, ok := m["trackHotNames"].(bool); ok {
+		s.TrackHotNames = v
+	}
+	if v, ok := m["routerRefreshInterval"].(float64); ok {
+		s.RouterRefreshInterval = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := m["raceBootstrap"].(bool); ok {
+		s.RaceBootstrap = v
+	}
+	if v, ok := m["startupBehavior"].(string); ok {
+		s.StartupBehavior = v
+	}
+	if v, ok := m["startupTimeout"].(float64); ok {
+		s.StartupTimeout = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := m["networkRecovery"].(bool); ok {
+		s.NetworkRecovery = v
+	}
+	if v, ok := m["soaMName"].(string); ok {
+		s.SOAMName = v
+	}
+	if v, ok := m["soaRName"].(string); ok {
+		s.SOARName = v
+	}
+	if v, ok := m["soaMinTTL"].(float64); ok && v >= 0 && v <= math.MaxUint32 {
+		s.SOAMinTTL = uint32(v)
+	}
+	if v, ok := m["maxNegativeTTL"].(float64); ok {
+		s.MaxNegativeTTL = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := m["preferredRetryInterval"].(float64); ok {
+		s.PreferredRetryInterval = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := m["preferredRetryMaxInterval"].(float64); ok {
+		s.PreferredRetryMaxInterval = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := m["idleTimeout"].(float64); ok {
+		s.IdleTimeout = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := m["forwardUnsupportedEDNS"].(bool); ok {
+		s.ForwardUnsupportedEDNS = v
+	}
+	if v, ok := m["maxInflight"].(float64); ok && v >= 0 {
+		s.MaxInflight = int(v)
+	}
+	if v, ok := m["startBackoffThreshold"].(float64); ok && v >= 0 {
+		s.StartBackoffThreshold = int(v)
+	}
+	if v, ok := m["startBackoffMax"].(float64); ok {
+		s.StartBackoffMax = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := m["dscp"].(float64); ok && v >= 0 {
+		s.DSCP = int(v)
+	}
+	if v, ok := m["statsdAddr"].(string); ok {
+		s.StatsDAddr = v
+	}
+	if v, ok := m["statsdPrefix"].(string); ok {
+		s.StatsDPrefix = v
+	}
+	if v, ok := m["statsdTags"].([]interface{}); ok {
+		s.StatsDTags = stringSlice(v)
+	}
+	if v, ok := m["statsdFlushInterval"].(float64); ok {
+		s.StatsDFlushInterval = time.Duration(v * float64(time.Second))
+	}
 	return s
 }
+
+// features maps the name of each optional feature which can be toggled with
+// WithFeatures, which is also its key, to its field.
+var features = map[string]func(s *Settings) *bool{
+	"stripHTTPSRecords":   func(s *Settings) *bool { return &s.StripHTTPSRecords },
+	"rotateAnswers":       func(s *Settings) *bool { return &s.RotateAnswers },
+	"rebindingProtection": func(s *Settings) *bool { return &s.RebindingProtection },
+	"authoritativeLocal":  func(s *Settings) *bool { return &s.AuthoritativeLocal },
+	"trackHotNames":       func(s *Settings) *bool { return &s.TrackHotNames },
+}
+
+// Features returns whether each optional feature is enabled.
+func (s Settings) Features() map[string]bool {
+	f := make(map[string]bool, len(features))
+	for name, field := range features {
+		f[name] = *field(&s)
+	}
+	return f
+}
+
+// WithFeatures returns a copy of the settings map m with the features which m
+// does not set toggled as in f. The features set by m are left as is so each
+// setting keeps a single source. An error is returned if f holds an unknown
+// feature or a value which is not a boolean.
+func WithFeatures(m, f map[string]interface{}) (map[string]interface{}, error) {
+	if err := CheckFeatures(f); err != nil {
+		return nil, err
+	}
+	res := make(map[string]interface{}, len(m)+len(f))
+	for name, on := range f {
+		res[name] = on
+	}
+	for k, v := range m {
+		res[k] = v
+	}
+	return res, nil
+}
+
+// CheckFeatures returns an error if f holds an unknown feature or a value
+// which is not a boolean.
+func CheckFeatures(f map[string]interface{}) error {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, found := features[name]; !found {
+			return fmt.Errorf("unknown feature %q", name)
+		}
+		if _, ok := f[name].(bool); !ok {
+			return fmt.Errorf("invalid value for feature %s: %v", name, f[name])
+		}
+	}
+	return nil
+}
+
+// stringSlice returns the strings of v, ignoring other values.
+func stringSlice(v []interface{}) []string {
+	var ss []string
+	for _, s := range v {
+		if s, ok := s.(string); ok {
+			ss = append(ss, s)
+		}
+	}
+	return ss
+}
+
+// ToMap returns s using the same keys as FromMap.
+func (s Settings) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":          s.Enabled,
+		"configuration":    s.Configuration,
+		"reportDeviceName": s.ReportDeviceName,
+		"deviceName":       s.DeviceName,
+		"checkUpdates":     s.CheckUpdates,
+		"updateChannel":    s.UpdateChannel,
+
+		"stripHTTPSRecords": s.StripHTTPSRecords,
+		"rotateAnswers":     s.RotateAnswers,
+		"mirrorUpstream":    s.MirrorUpstream,
+		"localDomains":      s.LocalDomains,
+		"localResolver":     s.LocalResolver,
+		"staticHosts":       s.StaticHosts,
+		"trackHotNames":     s.TrackHotNames,
+
+		"rebindingProtection": s.RebindingProtection,
+		"rebindingAllowlist":  s.RebindingAllowlist,
+		"authoritativeLocal":  s.AuthoritativeLocal,
+
+		"routerRefreshInterval": s.RouterRefreshInterval.Seconds(),
+		"raceBootstrap":         s.RaceBootstrap,
+		"startupBehavior":       s.StartupBehavior,
+		"startupTimeout":        s.StartupTimeout.Seconds(),
+		"networkRecovery":       s.NetworkRecovery,
+
+		"soaMName":  s.SOAMName,
+		"soaRName":  s.SOARName,
+		"soaMinTTL": float64(s.SOAMinTTL),
+
+		"maxNegativeTTL": s.MaxNegativeTTL.Seconds(),
+
+		"preferredRetryInterval":    s.PreferredRetryInterval.Seconds(),
+		"preferredRetryMaxInterval": s.PreferredRetryMaxInterval.Seconds(),
+		"idleTimeout":               s.IdleTimeout.Seconds(),
+		"forwardUnsupportedEDNS":    s.ForwardUnsupportedEDNS,
+		"maxInflight":               float64(s.MaxInflight),
+		"startBackoffThreshold":     float64(s.StartBackoffThreshold),
+		"startBackoffMax":           s.StartBackoffMax.Seconds(),
+		"dscp":                      float64(s.DSCP),
+
+		"statsdAddr":          s.StatsDAddr,
+		"statsdPrefix":        s.StatsDPrefix,
+		"statsdTags":          s.StatsDTags,
+		"statsdFlushInterval": s.StatsDFlushInterval.Seconds(),
+	}
+}
+
+// Effective returns the settings applied from m, each key mapping to its
+// value and the source it comes from, source being where m was received from.
+// Keys not present in m or which value cannot be decoded are reported with
+// their default value and SourceDefault. Values that may hold secrets are
+// redacted.
+func Effective(m map[string]interface{}, source string) map[string]interface{} {
+	defaults := FromMap(nil).ToMap()
+	eff := map[string]interface{}{}
+	for k, v := range FromMap(m).ToMap() {
+		src := SourceDefault
+		if mv, found := m[k]; found && validType(defaults[k], mv) {
+			src = source
+		}
+		if redact, found := redacted[k]; found {
+			v = redact(v)
+		}
+		eff[k] = map[string]interface{}{
+			"value":  v,
+			"source": src,
+		}
+	}
+	return eff
+}
+
+// redacted lists the keys which values may hold secrets with the function
+// redacting them.
+var redacted = map[string]func(interface{}) interface{}{
+	"mirrorUpstream": redactURL,
+}
+
+// redactURL only keeps the scheme and host of a URL as its credentials or path
+// may hold tokens.
+func redactURL(v interface{}) interface{} {
+	s, _ := v.(string)
+	u, err := url.Parse(s)
+	if err != nil || s == "" {
+		return s
+	}
+	if u.User == nil && u.Path == "" && u.RawQuery == "" {
+		return s
+	}
+	return u.Scheme + "://" + u.Host + "/[redacted]"
+}
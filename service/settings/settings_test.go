@@ -0,0 +1,136 @@
+package settings
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEffective(t *testing.T) {
+	tests := []struct {
+		name       string
+		m          map[string]interface{}
+		source     string
+		key        string
+		wantValue  interface{}
+		wantSource string
+	}{
+		{"missing", map[string]interface{}{}, SourceGUI, "rotateAnswers", false, SourceDefault},
+		{"gui", map[string]interface{}{"rotateAnswers": true}, SourceGUI, "rotateAnswers", true, SourceGUI},
+		{"file", map[string]interface{}{"rotateAnswers": true}, SourceFile, "rotateAnswers", true, SourceFile},
+		{"snapshot", map[string]interface{}{"configuration": "abcdef"}, SourceSnapshot, "configuration", "abcdef", SourceSnapshot},
+		{"wrong type", map[string]interface{}{"rotateAnswers": "yes"}, SourceGUI, "rotateAnswers", false, SourceDefault},
+		{"redacted", map[string]interface{}{"mirrorUpstream": "https://doh.example.com/secret"}, SourceGUI, "mirrorUpstream", "https://doh.example.com/[redacted]", SourceGUI},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eff := Effective(tt.m, tt.source)
+			e, ok := eff[tt.key].(map[string]interface{})
+			if !ok {
+				t.Fatalf("key %s not reported", tt.key)
+			}
+			if e["value"] != tt.wantValue {
+				t.Errorf("value = %v, want %v", e["value"], tt.wantValue)
+			}
+			if e["source"] != tt.wantSource {
+				t.Errorf("source = %v, want %v", e["source"], tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestFromMap(t *testing.T) {
+	tests := []struct {
+		name  string
+		m     map[string]interface{}
+		check func(s Settings) bool
+	}{
+		{"network recovery default", nil, func(s Settings) bool {
+			return s.NetworkRecovery
+		}},
+		{"network recovery disabled", map[string]interface{}{"networkRecovery": false}, func(s Settings) bool {
+			return !s.NetworkRecovery
+		}},
+		{"soa", map[string]interface{}{"soaMName": "ns.example.com.", "soaRName": "admin.example.com.", "soaMinTTL": 300.0}, func(s Settings) bool {
+			return s.SOAMName == "ns.example.com." && s.SOARName == "admin.example.com." && s.SOAMinTTL == 300
+		}},
+		{"preferred retry", map[string]interface{}{"preferredRetryInterval": 10.0, "preferredRetryMaxInterval": 600.0}, func(s Settings) bool {
+			return s.PreferredRetryInterval == 10*time.Second && s.PreferredRetryMaxInterval == 10*time.Minute
+		}},
+		{"idle timeout disabled", map[string]interface{}{"idleTimeout": -1.0}, func(s Settings) bool {
+			return s.IdleTimeout < 0
+		}},
+		{"max inflight", map[string]interface{}{"maxInflight": 64.0}, func(s Settings) bool {
+			return s.MaxInflight == 64
+		}},
+		{"start backoff", map[string]interface{}{"startBackoffThreshold": 5.0, "startBackoffMax": 60.0}, func(s Settings) bool {
+			return s.StartBackoffThreshold == 5 && s.StartBackoffMax == time.Minute
+		}},
+		{"max negative ttl", map[string]interface{}{"maxNegativeTTL": 60.0}, func(s Settings) bool {
+			return s.MaxNegativeTTL == time.Minute
+		}},
+		{"max negative ttl disabled", map[string]interface{}{"maxNegativeTTL": -1.0}, func(s Settings) bool {
+			return s.MaxNegativeTTL < 0
+		}},
+		{"dscp", map[string]interface{}{"dscp": 46.0}, func(s Settings) bool {
+			return s.DSCP == 46
+		}},
+		{"dscp negative ignored", map[string]interface{}{"dscp": -1.0}, func(s Settings) bool {
+			return s.DSCP == 0
+		}},
+		{"soa negative ttl ignored", map[string]interface{}{"soaMinTTL": -1.0}, func(s Settings) bool {
+			return s.SOAMinTTL == 0
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if s := FromMap(tt.m); !tt.check(s) {
+				t.Errorf("FromMap(%v) = %+v", tt.m, s)
+			}
+		})
+	}
+}
+
+func TestWithFeatures(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       map[string]interface{}
+		f       map[string]interface{}
+		want    map[string]bool // subset of the resulting features
+		wantErr bool
+	}{
+		{"toggled", map[string]interface{}{"configuration": "abcdef"}, map[string]interface{}{"rotateAnswers": true},
+			map[string]bool{"rotateAnswers": true, "stripHTTPSRecords": false}, false},
+		{"disabled", map[string]interface{}{}, map[string]interface{}{"rebindingProtection": false},
+			map[string]bool{"rebindingProtection": false}, false},
+		{"settings win", map[string]interface{}{"rotateAnswers": false}, map[string]interface{}{"rotateAnswers": true},
+			map[string]bool{"rotateAnswers": false}, false},
+		{"no toggle", map[string]interface{}{"trackHotNames": true}, nil,
+			map[string]bool{"trackHotNames": true}, false},
+		{"unknown feature", map[string]interface{}{}, map[string]interface{}{"dnssec": true}, nil, true},
+		{"invalid value", map[string]interface{}{}, map[string]interface{}{"rotateAnswers": "on"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(tt.m)
+			res, err := WithFeatures(tt.m, tt.f)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WithFeatures error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(tt.m) != before {
+				t.Errorf("settings map modified: %v", tt.m)
+			}
+			if err != nil {
+				return
+			}
+			features := FromMap(res).Features()
+			for name, want := range tt.want {
+				if features[name] != want {
+					t.Errorf("feature %s = %v, want %v", name, features[name], want)
+				}
+			}
+			if res["configuration"] != tt.m["configuration"] {
+				t.Errorf("configuration = %v, want %v", res["configuration"], tt.m["configuration"])
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nextdns/windows/proxy"
+	"github.com/nextdns/windows/settings"
+)
+
+// snapshotVersion is the version of the snapshot format, incremented on
+// incompatible changes.
+const snapshotVersion = 1
+
+// snapshot holds the runtime state of the service so a support case can be
+// reproduced on another machine. It contains the settings, including the
+// configuration ID, and the most queried names, so it is only available when
+// running with -debug. The proxy stats are included for the diagnosis but not
+// restored.
+type snapshot struct {
+	Version  int                    `json:"version"`
+	Time     time.Time              `json:"time"`
+	Settings map[string]interface{} `json:"settings"`
+	Proxy    *proxy.Snapshot        `json:"proxy,omitempty"`
+}
+
+// writeSnapshot writes the current state of s to path, creating its directory
+// if needed.
+func (s *nextdnsSvc) writeSnapshot(path string) error {
+	m, _ := s.lastSettings()
+	snap := snapshot{
+		Version:  snapshotVersion,
+		Time:     time.Now(),
+		Settings: m,
+	}
+	if p, ok := s.impl.(*proxy.Proxy); ok {
+		ps := p.TakeSnapshot()
+		snap.Proxy = &ps
+	}
+	b, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// restoreSnapshot restores the snapshot at path, applying its settings with
+// apply.
+func (s *nextdnsSvc) restoreSnapshot(path string, apply func(m map[string]interface{}, source string) error) error {
+	snap, err := readSnapshot(path)
+	if err != nil {
+		return err
+	}
+	if err = apply(snap.Settings, settings.SourceSnapshot); err != nil {
+		return err
+	}
+	if p, ok := s.impl.(*proxy.Proxy); ok && snap.Proxy != nil {
+		return p.RestoreSnapshot(*snap.Proxy)
+	}
+	return nil
+}
+
+// readSnapshot reads a snapshot written by writeSnapshot.
+func readSnapshot(path string) (snapshot, error) {
+	var snap snapshot
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return snap, err
+	}
+	if err = json.Unmarshal(b, &snap); err != nil {
+		return snap, fmt.Errorf("%s: %v", path, err)
+	}
+	if snap.Version != snapshotVersion {
+		return snap, fmt.Errorf("%s: unsupported snapshot version %d", path, snap.Version)
+	}
+	if snap.Settings == nil {
+		return snap, fmt.Errorf("%s: no settings", path)
+	}
+	return snap, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/nextdns/windows/proxy"
+	"github.com/nextdns/windows/settings"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshots", "support.json")
+
+	p := &proxy.Proxy{}
+	if err := p.RestoreSnapshot(proxy.Snapshot{HotNames: map[string]uint64{"example.com.": 3, "nextdns.io.": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	m := map[string]interface{}{"configuration": "abcdef", "rotateAnswers": true, "idleTimeout": 60.0}
+	s := &nextdnsSvc{impl: p}
+	s.setSettings(m, settings.SourceGUI)
+	if err := s.writeSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &proxy.Proxy{}
+	var applied map[string]interface{}
+	var source string
+	rs := &nextdnsSvc{impl: restored}
+	err = rs.restoreSnapshot(path, func(m map[string]interface{}, src string) error {
+		applied, source = m, src
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(applied, m) || source != settings.SourceSnapshot {
+		t.Errorf("applied %v from %s, want %v from %s", applied, source, m, settings.SourceSnapshot)
+	}
+	if got, want := restored.TakeSnapshot(), p.TakeSnapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored proxy %+v, want %+v", got, want)
+	}
+	if got, want := restored.HotNames(1, false), p.HotNames(1, false); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored hot names %v, want %v", got, want)
+	}
+}
+
+func TestReadSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", `{"version": 1, "settings": {"enabled": true}}`, false},
+		{"other version", `{"version": 2, "settings": {"enabled": true}}`, true},
+		{"no settings", `{"version": 1}`, true},
+		{"null settings", `{"version": 1, "settings": null}`, true},
+		{"invalid", `{"version": 1,`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".json")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readSnapshot(path); (err != nil) != tt.wantErr {
+				t.Errorf("readSnapshot = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
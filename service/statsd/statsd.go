@@ -0,0 +1,169 @@
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFlushInterval defines the default flush interval used when none is
+// given to SetConfig.
+const DefaultFlushInterval = 10 * time.Second
+
+const (
+	// maxPacketSize is the maximum size of a datagram sent to the server,
+	// chosen to stay under common MTUs.
+	maxPacketSize = 1432
+
+	// maxTimings is the maximum number of timing samples buffered between two
+	// flushes. Extra samples are dropped.
+	maxTimings = 1000
+)
+
+// Client buffers metrics and periodically sends them to a StatsD or DogStatsD
+// server over UDP. A nil or unconfigured Client discards metrics, and errors
+// sending to the server never affect the callers.
+type Client struct {
+	// ErrorLog specifies an optional log function for errors. If not set,
+	// errors are not reported.
+	ErrorLog func(error)
+
+	mu       sync.Mutex
+	addr     string
+	prefix   string
+	tags     string
+	counters map[string]int64
+	timings  map[string][]time.Duration
+	ntimings int
+	stop     chan struct{}
+}
+
+// SetConfig configures c to send metrics to addr every flushInterval. Each
+// metric name is prefixed with prefix, and tags, in the key:value form, are
+// added using the DogStatsD extension. An empty addr disables c.
+func (c *Client) SetConfig(addr, prefix string, tags []string, flushInterval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.addr = addr
+	c.prefix = prefix
+	c.tags = ""
+	if len(tags) > 0 {
+		c.tags = "|#" + strings.Join(tags, ",")
+	}
+	c.counters = nil
+	c.timings = nil
+	c.ntimings = 0
+	if addr == "" {
+		return
+	}
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
+	}
+	c.stop = make(chan struct{})
+	go c.run(c.stop, flushInterval)
+}
+
+// Count adds value to the counter name.
+func (c *Client) Count(name string, value int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.addr == "" {
+		return
+	}
+	if c.counters == nil {
+		c.counters = map[string]int64{}
+	}
+	c.counters[name] += value
+}
+
+// Timing records a timing sample of d for name.
+func (c *Client) Timing(name string, d time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.addr == "" || c.ntimings >= maxTimings {
+		return
+	}
+	if c.timings == nil {
+		c.timings = map[string][]time.Duration{}
+	}
+	c.timings[name] = append(c.timings[name], d)
+	c.ntimings++
+}
+
+func (c *Client) run(stop chan struct{}, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if err := c.flush(); err != nil && c.ErrorLog != nil {
+				c.ErrorLog(fmt.Errorf("statsd: %v", err))
+			}
+		}
+	}
+}
+
+// flush sends the buffered metrics to the server and resets them.
+func (c *Client) flush() error {
+	c.mu.Lock()
+	addr := c.addr
+	lines := c.linesLocked()
+	c.counters = nil
+	c.timings = nil
+	c.ntimings = 0
+	c.mu.Unlock()
+	if len(lines) == 0 {
+		return nil
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var buf bytes.Buffer
+	for _, l := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(l) > maxPacketSize {
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(l)
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+func (c *Client) linesLocked() []string {
+	var lines []string
+	for name, v := range c.counters {
+		lines = append(lines, fmt.Sprintf("%s%s:%d|c%s", c.prefix, name, v, c.tags))
+	}
+	for name, samples := range c.timings {
+		for _, d := range samples {
+			ms := float64(d) / float64(time.Millisecond)
+			lines = append(lines, fmt.Sprintf("%s%s:%.3f|ms%s", c.prefix, name, ms, c.tags))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
@@ -1,7 +1,8 @@
 package svc
 
-func Install(name, displayName, desc string) error {
-	return install(name, displayName, desc)
+// Install registers the service, started with args.
+func Install(name, displayName, desc string, args ...string) error {
+	return install(name, displayName, desc, args)
 }
 
 func Remove(name string) error {
@@ -2,7 +2,7 @@
 
 package svc
 
-func install(name, displayName, desc string) error {
+func install(name, displayName, desc string, args []string) error {
 	panic("not implemented")
 }
 
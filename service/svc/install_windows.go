@@ -37,7 +37,7 @@ func exePath() (string, error) {
 	return "", err
 }
 
-func install(name, displayName, desc string) error {
+func install(name, displayName, desc string, args []string) error {
 	exepath, err := exePath()
 	if err != nil {
 		return err
@@ -55,7 +55,7 @@ func install(name, displayName, desc string) error {
 	s, err = m.CreateService(name, exepath, mgr.Config{
 		DisplayName: desc,
 		StartType:   mgr.StartAutomatic,
-	})
+	}, args...)
 	if err != nil {
 		return err
 	}
@@ -1,10 +1,63 @@
 package svc
 
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// DefaultStopTimeout is the time given to Service.Stop when the service
+	// does not implement StopTimeouter.
+	DefaultStopTimeout = 10 * time.Second
+
+	// MaxStopTimeout is the maximum stop time accepted. The SCM may kill
+	// the process if it does not stop within roughly this amount of time.
+	MaxStopTimeout = 20 * time.Second
+)
+
 type Service interface {
 	Start(Logger) error
 	Stop(Logger) error
 }
 
+// StopTimeouter is an optional interface a Service can implement to set the
+// time budget given to Stop. Once exceeded, the process exits without waiting
+// for Stop to return. The budget is bounded to MaxStopTimeout.
+type StopTimeouter interface {
+	StopTimeout() time.Duration
+}
+
+func stopTimeout(s Service) time.Duration {
+	timeout := DefaultStopTimeout
+	if st, ok := s.(StopTimeouter); ok && st.StopTimeout() > 0 {
+		timeout = st.StopTimeout()
+	}
+	if timeout > MaxStopTimeout {
+		timeout = MaxStopTimeout
+	}
+	return timeout
+}
+
+// errStopTimeout is returned by stopWithin when Stop exceeds its budget.
+var errStopTimeout = errors.New("stop timeout")
+
+// stopWithin calls s.Stop and returns its error, or errStopTimeout if it does
+// not return within timeout, in which case it is left running.
+func stopWithin(s Service, log Logger, timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Stop(log)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case err := <-errc:
+		return err
+	case <-t.C:
+		return errStopTimeout
+	}
+}
+
 type Logger interface {
 	Info(string)
 	Warn(string)
@@ -14,3 +67,9 @@ type Logger interface {
 func Run(s Service, name string, debug bool) error {
 	return run(s, name, debug)
 }
+
+// IsInteractive reports whether the process was launched by a user rather than
+// by the SCM as a service.
+func IsInteractive() (bool, error) {
+	return isInteractive()
+}
@@ -5,3 +5,7 @@ package svc
 func run(s Service, name string, debug bool) error {
 	panic("not implemented")
 }
+
+func isInteractive() (bool, error) {
+	return true, nil
+}
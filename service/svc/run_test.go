@@ -0,0 +1,87 @@
+package svc
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type testService struct {
+	drain       chan struct{} // if not nil, Stop blocks until it is closed
+	stopErr     error
+	stopTimeout time.Duration
+	cleaned     chan struct{}
+}
+
+func (s *testService) Start(Logger) error { return nil }
+
+func (s *testService) Stop(Logger) error {
+	// Critical cleanup first, then the drain.
+	close(s.cleaned)
+	if s.drain != nil {
+		<-s.drain
+	}
+	return s.stopErr
+}
+
+func (s *testService) StopTimeout() time.Duration { return s.stopTimeout }
+
+type nopLogger struct{}
+
+func (nopLogger) Info(string)  {}
+func (nopLogger) Warn(string)  {}
+func (nopLogger) Error(string) {}
+
+func TestStopWithin(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name    string
+		blocks  bool
+		err     error
+		want    error
+		maxTime time.Duration
+	}{
+		{"fast", false, nil, nil, time.Second},
+		{"failed", false, errFailed, errFailed, time.Second},
+		{"too slow drain", true, nil, errStopTimeout, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &testService{stopErr: tt.err, cleaned: make(chan struct{})}
+			if tt.blocks {
+				s.drain = make(chan struct{})
+				// Let the Stop left running return.
+				defer close(s.drain)
+			}
+			start := time.Now()
+			if err := stopWithin(s, nopLogger{}, 50*time.Millisecond); err != tt.want {
+				t.Errorf("stopWithin = %v, want %v", err, tt.want)
+			}
+			if d := time.Since(start); d > tt.maxTime {
+				t.Errorf("returned after %v", d)
+			}
+			select {
+			case <-s.cleaned:
+			default:
+				t.Error("critical cleanup not run")
+			}
+		})
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		s    Service
+		want time.Duration
+	}{
+		{"default", &testService{}, DefaultStopTimeout},
+		{"configured", &testService{stopTimeout: 5 * time.Second}, 5 * time.Second},
+		{"capped", &testService{stopTimeout: time.Minute}, MaxStopTimeout},
+	}
+	for _, tt := range tests {
+		if got := stopTimeout(tt.s); got != tt.want {
+			t.Errorf("%s: stopTimeout = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
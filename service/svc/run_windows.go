@@ -2,6 +2,7 @@ package svc
 
 import (
 	"fmt"
+	"time"
 
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/debug"
@@ -45,8 +46,16 @@ loop:
 		case svc.Interrogate:
 			changes <- c.CurrentStatus
 		case svc.Stop, svc.Shutdown:
-			changes <- svc.Status{State: svc.StopPending}
-			if err := s.Stop(s.log); err != nil {
+			timeout := stopTimeout(s.Service)
+			changes <- svc.Status{State: svc.StopPending, WaitHint: uint32(timeout / time.Millisecond)}
+			switch err := stopWithin(s.Service, s.log, timeout); err {
+			case nil:
+			case errStopTimeout:
+				// Exit before the SCM kills us. Services must perform their
+				// critical cleanup first in Stop.
+				s.log.Error(fmt.Sprintf("stop did not complete within %v", timeout))
+				return true, 3
+			default:
 				s.log.Error(fmt.Sprint(err))
 				return true, 2
 			}
@@ -84,3 +93,7 @@ func run(s Service, name string, isDebug bool) error {
 	elog.Info(1, fmt.Sprintf("%s service stopped", name))
 	return nil
 }
+
+func isInteractive() (bool, error) {
+	return svc.IsAnInteractiveSession()
+}
@@ -0,0 +1,25 @@
+package windoh
+
+import "testing"
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		name                  string
+		deviceName, model, id string
+		want                  string
+	}{
+		{"not reported", "", "", "", "https://windows.dns.nextdns.io/abcdef"},
+		{"reported", "My PC", "Laptop", "1234", "https://windows.dns.nextdns.io/abcdef/My%20PC/Laptop/1234"},
+		{"escaped", "a/b", "c?d", "e", "https://windows.dns.nextdns.io/abcdef/a%2Fb/c%3Fd/e"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{}
+			c.SetConfigID("abcdef")
+			c.SetDeviceInfo(tt.deviceName, tt.model, tt.id, "1.0")
+			if got := c.url(); got != tt.want {
+				t.Errorf("url = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}